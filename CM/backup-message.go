@@ -1,6 +1,61 @@
 package CM
 
+import "time"
+
 type SyncMessage struct {
 	Records map[int]Record
-	WriteQueue []WriteRequest
+	Queues map[int][]Request
+	Transitions map[int]Transition
+	Members map[int]string
+	Lost map[int]bool
+	PageData map[int][]byte
+	LastSeen map[int]time.Time
+	Pending map[string]Request
+	NextID int
+	Seq int // Sequence number of the last mutation included
+	Epoch int // Epoch of the central manager sending the metadata
+}
+
+// Lease renewal sent by the primary to the backup central manager
+type LeaseMessage struct {
+	Epoch int // Epoch of the primary central manager, renewals from an older one are refused
+	Duration time.Duration // How long the lease lasts from the moment the backup receives the renewal
+	LastSeen map[int]time.Time // Liveness table of the primary, replicated along with every renewal
+	Seq int // Last mutation every standby that is up has acked, a standby without it knows it is behind
+	Behind bool // Set in the reply of a standby that may be missing mutations, the active central manager then resyncs it
+}
+
+// A single mutation shipped from the primary to the backup central manager
+type ShipMessage struct {
+	Seq int // Sequence number of the mutation, the backup applies them strictly in order
+	Epoch int // Epoch of the primary central manager, the backup refuses mutations from an older one
+	Mutation Mutation
+}
+
+// Allocates the maps that gob leaves out when they are empty
+func (msg *SyncMessage) init() {
+	if msg.Records == nil {
+		msg.Records = make(map[int]Record)
+	}
+	if msg.Queues == nil {
+		msg.Queues = make(map[int][]Request)
+	}
+	if msg.Transitions == nil {
+		msg.Transitions = make(map[int]Transition)
+	}
+	if msg.Members == nil {
+		msg.Members = make(map[int]string)
+	}
+	if msg.Lost == nil {
+		msg.Lost = make(map[int]bool)
+	}
+	if msg.PageData == nil {
+		msg.PageData = make(map[int][]byte)
+	}
+	if msg.LastSeen == nil {
+		msg.LastSeen = make(map[int]time.Time)
+	}
+	if msg.Pending == nil {
+		msg.Pending = make(map[string]Request)
+	}
 }
\ No newline at end of file
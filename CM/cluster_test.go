@@ -0,0 +1,198 @@
+package CM
+
+import (
+	"ivy/client"
+	"ivy/config"
+	"ivy/message"
+	"ivy/utils"
+	"testing"
+	"time"
+)
+
+// Configuration with timings short enough for a test to see failovers and elections
+func testConfig() config.Config {
+	cfg := config.Default()
+	cfg.LeaseDuration = config.Duration(600 * time.Millisecond)
+	cfg.HealthCheckInterval = config.Duration(100 * time.Millisecond)
+	cfg.BackupInterval = config.Duration(200 * time.Millisecond)
+	cfg.ElectionTimeout = config.Duration(300 * time.Millisecond)
+	cfg.HeartbeatInterval = config.Duration(50 * time.Millisecond)
+	cfg.RequestTimeout = config.Duration(4 * time.Second)
+	return cfg
+}
+
+// Starts the RPC servers of the central managers and waits until they answer
+func serve(t *testing.T, cms ...*CentralManager) {
+	t.Helper()
+	for _, cm := range cms {
+		go cm.StartRPCServer()
+	}
+	for _, cm := range cms {
+		waitFor(t, time.Second, cm.IP+" to listen", func() bool {
+			_, err := cm.call(cm.IP, "CentralManager.Ping", message.Message{Type: PING})
+			return err == nil
+		})
+	}
+}
+
+// Opens a client listening on a free port of host over the transport
+func openClient(t *testing.T, cfg config.Config, transport utils.Transport, host string) *client.Client {
+	t.Helper()
+	ccfg := client.NewConfig(cfg)
+	ccfg.IP = host + ":0"
+	ccfg.Transport = transport
+	c, err := client.Open(ccfg)
+	if err != nil {
+		t.Fatalf("opening a client on %s: %s", host, err)
+	}
+	return c
+}
+
+// Waits for cond to hold, failing the test once the timeout has passed
+func waitFor(t *testing.T, timeout time.Duration, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(timeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+// Returns the record of the page as seen by the central manager
+func recordOf(cm *CentralManager, pageID int) (Record, bool) {
+	cm.Lock.Lock()
+	defer cm.Lock.Unlock()
+	record, ok := cm.Records[pageID]
+	return record, ok
+}
+
+func TestFailoverToBackup(t *testing.T) {
+	mem := utils.NewMemory()
+	cfg := testConfig()
+	cfg.Primary = "10.0.1.1:7000"
+	cfg.Backup = "10.0.1.2:7000"
+	primary := NewCentralManager(cfg.Primary, cfg)
+	backup := NewCentralManager(cfg.Backup, cfg)
+	toPrimary, toBackup, toClients := utils.NewFaulty(mem), utils.NewFaulty(mem), utils.NewFaulty(mem)
+	primary.UseTransport(toPrimary)
+	backup.UseTransport(toBackup)
+	serve(t, primary, backup)
+	go primary.HoldLease()
+	go primary.StartBackup()
+	go backup.HealthCheck()
+	go backup.HoldLease()
+	go backup.StartBackup()
+
+	writer := openClient(t, cfg, toClients, "10.0.1.3")
+	reader := openClient(t, cfg, toClients, "10.0.1.4")
+	waitFor(t, 2*time.Second, "the backup to be synced", backup.caughtUp)
+	if err := writer.Write(0, []byte("A")); err != nil {
+		t.Fatalf("write before the failover: %s", err)
+	}
+
+	// Cut the primary off from everyone, the backup takes over once the lease runs out
+	toPrimary.Cut(cfg.Backup, writer.IP, reader.IP)
+	toBackup.Cut(cfg.Primary)
+	toClients.Cut(cfg.Primary)
+	if err := writer.Write(cfg.PageSize, []byte("B")); err != nil {
+		t.Fatalf("write across the failover: %s", err)
+	}
+	if backup.CurrentEpoch() <= primary.CurrentEpoch() {
+		t.Errorf("backup is in epoch %d, want newer than the primary's %d", backup.CurrentEpoch(), primary.CurrentEpoch())
+	}
+	if err := primary.checkEpoch(0); err == nil {
+		t.Errorf("the primary still serves after losing its lease")
+	}
+	data, err := reader.Read(0, 1)
+	if err != nil || string(data) != "A" {
+		t.Fatalf("read after the failover: %q %v, want the write made before it", data, err)
+	}
+
+	// Once the partition heals the backup hands the metadata back to the primary
+	toPrimary.Heal(cfg.Backup, writer.IP, reader.IP)
+	toBackup.Heal(cfg.Primary)
+	toClients.Heal(cfg.Primary)
+	waitFor(t, 5*time.Second, "the primary to take over again", func() bool {
+		_, ok := recordOf(primary, 1)
+		return ok && primary.active() && primary.CurrentEpoch() >= backup.CurrentEpoch()
+	})
+	data, err = reader.Read(cfg.PageSize, 1)
+	if err != nil || string(data) != "B" {
+		t.Fatalf("read after the primary is back: %q %v, want the write made during the failover", data, err)
+	}
+}
+
+func TestStandbyRefusesClients(t *testing.T) {
+	mem := utils.NewMemory()
+	cfg := testConfig()
+	cfg.Primary = "10.0.4.1:7000"
+	cfg.Backup = "10.0.4.2:7000"
+	cfg.RequestTimeout = config.Duration(time.Second)
+	primary := NewCentralManager(cfg.Primary, cfg)
+	backup := NewCentralManager(cfg.Backup, cfg)
+	primary.UseTransport(mem)
+	backup.UseTransport(mem)
+	serve(t, primary, backup)
+	go primary.HoldLease()
+	go primary.StartBackup()
+	go backup.HealthCheck()
+	waitFor(t, 2*time.Second, "the backup to be synced", backup.caughtUp)
+
+	// A client that only reaches the backup cannot join while the primary holds the lease
+	toClients := utils.NewFaulty(mem)
+	toClients.Cut(cfg.Primary)
+	ccfg := client.NewConfig(cfg)
+	ccfg.IP = "10.0.4.3:0"
+	ccfg.Transport = toClients
+	if c, err := client.Open(ccfg); err == nil {
+		t.Fatalf("client %d joined through the backup while the primary is active", c.ID)
+	}
+	backup.Lock.Lock()
+	members := len(backup.Members)
+	backup.Lock.Unlock()
+	if members != 0 {
+		t.Errorf("backup has %d members, want none", members)
+	}
+
+	toClients.Heal(cfg.Primary)
+	c := openClient(t, cfg, toClients, "10.0.4.3")
+	if _, err := backup.call(backup.IP, "CentralManager.ReceiveRequest", message.Message{Type: HEARTBEAT, ID: c.ID, IP: c.IP}); err == nil || !isStaleEpoch(err) {
+		t.Errorf("backup answered a heartbeat with %v, want a stale epoch error", err)
+	}
+}
+
+func TestCutOffClientStopsServingCache(t *testing.T) {
+	mem := utils.NewMemory()
+	cfg := testConfig()
+	cfg.Primary = "10.0.6.1:7000"
+	cfg.ClientHeartbeat = config.Duration(100 * time.Millisecond)
+	cfg.ClientTimeout = config.Duration(500 * time.Millisecond)
+	cfg.InvalidateTimeout = config.Duration(300 * time.Millisecond)
+	cfg.RequestTimeout = config.Duration(time.Second)
+	cm := NewCentralManager(cfg.Primary, cfg)
+	toCM := utils.NewFaulty(mem)
+	cm.UseTransport(toCM)
+	serve(t, cm)
+
+	writer := openClient(t, cfg, mem, "10.0.6.2")
+	toReader := utils.NewFaulty(mem)
+	reader := openClient(t, cfg, toReader, "10.0.6.3")
+	if err := writer.Write(0, []byte("A")); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := reader.Read(0, 1); err != nil || string(data) != "A" {
+		t.Fatalf("read before the partition: %q %v", data, err)
+	}
+
+	// The reader is cut off, so the write evicts it instead of invalidating its copy
+	toCM.Cut(reader.IP)
+	toReader.Cut(cfg.Primary)
+	if err := writer.Write(0, []byte("B")); err != nil {
+		t.Fatalf("write while the reader is cut off: %s", err)
+	}
+	if data, err := reader.Read(0, 1); err == nil {
+		t.Fatalf("the cut off reader still serves %q from its cache", data)
+	}
+}
@@ -0,0 +1,76 @@
+package CM
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Every time a central manager takes over it moves to a new epoch, which is attached to the messages it sends.
+// A central manager that sees a newer epoch has been replaced and stops serving until it has synced
+// its metadata from the active one, so two central managers can never both serve the clients.
+
+const STALE_EPOCH = "stale central manager epoch"
+
+func staleEpoch(epoch int, current int) error {
+	return fmt.Errorf("%s: got epoch %d, current epoch is %d", STALE_EPOCH, epoch, current)
+}
+
+// Checks whether err, possibly coming back over RPC, reports a stale epoch
+func isStaleEpoch(err error) bool {
+	return err != nil && strings.Contains(err.Error(), STALE_EPOCH)
+}
+
+// Rejects requests unless this central manager is the active one, and fences it when the request carries a newer epoch.
+// A standby that has not taken over refuses them like a replaced central manager, so the clients try again elsewhere.
+func (cm *CentralManager) checkEpoch(epoch int) error {
+	if err := cm.raft.checkLeader(); err != nil {
+		return err // A follower would be fenced by the newer epoch of the leader instead of naming it
+	}
+	cm.Lock.Lock()
+	defer cm.Lock.Unlock()
+	if cm.IsBackup && !cm.isDead {
+		return errors.New(STALE_EPOCH + ": this central manager is standing by")
+	}
+	if epoch > cm.Epoch && !cm.fenced {
+		fmt.Printf("[CENTRAL-MANAGER] Epoch %d is newer than ours (%d), stepping down until the metadata is synced\n", epoch, cm.Epoch)
+		cm.fenced = true
+	}
+	if cm.fenced {
+		return errors.New(STALE_EPOCH + ": this central manager has been replaced")
+	}
+	if !cm.holdsLease() {
+		return errors.New(STALE_EPOCH + ": the lease of this central manager has run out")
+	}
+	return nil
+}
+
+// Fences this central manager after the backup refused one of its messages
+func (cm *CentralManager) stepDown(err error) error {
+	cm.Lock.Lock()
+	defer cm.Lock.Unlock()
+	if !cm.fenced {
+		fmt.Printf("[CENTRAL-MANAGER] Another central manager has taken over, stepping down: %s\n", err)
+		cm.fenced = true
+	}
+	return err
+}
+
+// Returns the epoch to take over in, must be called with the lock held.
+// Each central manager in the succession only takes the epochs equal to its rank modulo the length of the succession,
+// so two of them that both take over after the same epoch still end up in different ones and the newer one wins.
+func (cm *CentralManager) nextEpoch() int {
+	n := len(cm.succession())
+	if cm.Rank < 0 || cm.Rank >= n {
+		return cm.Epoch + 1 // Not part of the succession, e.g. a central manager recovering from the clients
+	}
+	epoch := cm.Epoch + 1
+	return epoch + ((cm.Rank-epoch)%n+n)%n
+}
+
+// Returns the current epoch
+func (cm *CentralManager) CurrentEpoch() int {
+	cm.Lock.Lock()
+	defer cm.Lock.Unlock()
+	return cm.Epoch
+}
@@ -0,0 +1,55 @@
+package CM
+
+import (
+	"ivy/config"
+	"ivy/message"
+	"ivy/utils"
+	"strings"
+	"testing"
+)
+
+func TestFixedShardsPages(t *testing.T) {
+	cfg := testConfig()
+	cfg.Mode = config.FIXED
+	cfg.Managers = []string{"10.0.6.1:7000", "10.0.6.2:7000"}
+	mem := utils.NewMemory()
+	var managers []*CentralManager
+	for _, ip := range cfg.Managers {
+		cm := NewCentralManager(ip, cfg)
+		cm.UseTransport(mem)
+		managers = append(managers, cm)
+	}
+	serve(t, managers...)
+
+	writer := openClient(t, cfg, mem, "10.0.6.3")
+	reader := openClient(t, cfg, mem, "10.0.6.4")
+	for pageID := 0; pageID < 4; pageID++ {
+		if err := writer.Write(pageID*cfg.PageSize, []byte{byte('A' + pageID)}); err != nil {
+			t.Fatalf("write to page %d: %s", pageID, err)
+		}
+	}
+	for pageID := 0; pageID < 4; pageID++ {
+		data, err := reader.Read(pageID*cfg.PageSize, 1)
+		if err != nil || data[0] != byte('A'+pageID) {
+			t.Fatalf("read of page %d: %q %v", pageID, data, err)
+		}
+	}
+
+	// Each central manager only has the records of its own shard
+	for pageID := 0; pageID < 4; pageID++ {
+		for shard, cm := range managers {
+			record, ok := recordOf(cm, pageID)
+			if ok != (pageID%2 == shard) {
+				t.Errorf("central manager %d has a record of page %d: %v", shard, pageID, ok)
+			} else if ok && (record.Owner.ID != writer.ID || len(record.Copies) != 1 || record.Copies[0].ID != reader.ID) {
+				t.Errorf("page %d recorded as %v, want owned by the writer and copied by the reader", pageID, record)
+			}
+		}
+	}
+
+	// A request sent to the central manager of another shard is refused
+	_, err := managers[0].call(cfg.Managers[1], "CentralManager.ReceiveRequest", message.Message{Type: READ, ID: reader.ID, IP: reader.IP, PageID: 0})
+	if err == nil || !strings.Contains(err.Error(), "not managed") {
+		t.Errorf("request for page 0 at the second central manager: %v", err)
+	}
+}
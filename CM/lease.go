@@ -0,0 +1,128 @@
+package CM
+
+import (
+	"fmt"
+	"ivy/utils"
+	"time"
+)
+
+// Function to keep renewing the lease of the active central manager with the others in the succession.
+// A standby that has not accepted a renewal for a whole LeaseDuration may have found the lease expired and taken over,
+// so the active central manager stops serving from then on until every standby accepts one again.
+// A standby that is down, rather than cut off, has to be resynced before it may take over, so it does not count.
+func (cm *CentralManager) HoldLease() {
+	cm.Lock.Lock()
+	cm.holdingLease = true
+	cm.Lock.Unlock()
+	for {
+		if cm.active() && !cm.rebooting() {
+			sent := time.Now()
+			cm.Lock.Lock()
+			lease := LeaseMessage{Epoch: cm.Epoch, Duration: cm.LeaseDuration, LastSeen: cm.liveness(), Seq: cm.shipped}
+			cm.Lock.Unlock()
+			for _, ip := range cm.others() {
+				go func() {
+					var reply LeaseMessage
+					err := cm.callManager(ip, "CentralManager.RenewLease", lease, &reply)
+					if isStaleEpoch(err) {
+						cm.stepDown(err) // Another central manager has already taken over
+					} else if err == nil || utils.IsDown(err) {
+						cm.renewed(ip, sent)
+					}
+					if reply.Behind {
+						cm.lagging(ip, sent)
+					}
+				}()
+			}
+			cm.Lock.Lock()
+			cm.holdsLease() // Reports losing or getting back the lease even while no requests come in
+			cm.Lock.Unlock()
+		}
+		time.Sleep(cm.LeaseDuration / 3) // Several renewals fit in one lease, so a lost one does not let it expire
+	}
+}
+
+// Records a renewal accepted by the standby, sent at the given time
+func (cm *CentralManager) renewed(ip string, sent time.Time) {
+	cm.Lock.Lock()
+	defer cm.Lock.Unlock()
+	if sent.After(cm.renewals[ip]) {
+		cm.renewals[ip] = sent
+	}
+}
+
+// Leaves the standby to be resynced by StartBackup once it has replied to a renewal that it is behind,
+// unless the renewal was sent before the standby was last resynced
+func (cm *CentralManager) lagging(ip string, sent time.Time) {
+	cm.shipLock.Lock()
+	defer cm.shipLock.Unlock()
+	if sent.After(cm.resynced[ip]) {
+		cm.synced[ip] = false
+	}
+}
+
+// Checks that no standby can have found the lease expired, must be called with the lock held.
+// The standbys time the lease from when they receive a renewal, so timing it from when it was sent is on the safe side.
+func (cm *CentralManager) holdsLease() bool {
+	if !cm.holdingLease || (cm.IsBackup && !cm.isDead) || cm.fenced {
+		return true // Only the active central manager holds the lease
+	}
+	var expired []string
+	for _, ip := range cm.others() {
+		renewed := cm.renewals[ip]
+		if renewed.Before(cm.leaseSince) {
+			renewed = cm.leaseSince // The standbys cannot have timed out a lease this central manager held before it became active
+		}
+		if time.Since(renewed) > cm.LeaseDuration {
+			expired = append(expired, ip)
+		}
+	}
+	if len(expired) > 0 && !cm.leaseLost {
+		fmt.Printf("[CENTRAL-MANAGER] The lease has not been renewed with %v for %s, stopping until it is\n", expired, cm.LeaseDuration)
+		cm.leaseLost = true
+	} else if len(expired) == 0 && cm.leaseLost {
+		fmt.Printf("[CENTRAL-MANAGER] The lease has been renewed, serving again\n")
+		cm.leaseLost = false
+	}
+	return !cm.leaseLost
+}
+
+// RPC called by the active central manager to renew its lease
+func (cm *CentralManager) RenewLease(msg LeaseMessage, reply *LeaseMessage) error {
+	cm.Lock.Lock()
+	defer cm.Lock.Unlock()
+	if err := cm.acceptActive(msg.Epoch); err != nil {
+		return err
+	}
+	cm.leaseExpiry = time.Now().Add(msg.Duration) // Measured on our own clock, so the clocks do not have to agree
+	cm.LastSeen = msg.LastSeen
+	if cm.LastSeen == nil {
+		cm.LastSeen = make(map[int]time.Time) // Gob leaves out empty maps
+	}
+	if msg.Seq > cm.Seq && !cm.behind {
+		fmt.Printf("[CENTRAL-MANAGER] Missing mutations %d to %d, not taking over until synced\n", cm.Seq+1, msg.Seq)
+		cm.behind = true
+	}
+	*reply = LeaseMessage{Epoch: cm.Epoch, Duration: msg.Duration, Behind: cm.behind}
+	return nil
+}
+
+// Checks if this standby has every mutation the active central manager is known to have committed
+func (cm *CentralManager) caughtUp() bool {
+	cm.Lock.Lock()
+	defer cm.Lock.Unlock()
+	return !cm.behind
+}
+
+// Checks if the lease of the active central manager has run out
+func (cm *CentralManager) leaseExpired() bool {
+	cm.Lock.Lock()
+	defer cm.Lock.Unlock()
+	return time.Now().After(cm.leaseExpiry)
+}
+
+func (cm *CentralManager) extendLease(duration time.Duration) {
+	cm.Lock.Lock()
+	defer cm.Lock.Unlock()
+	cm.leaseExpiry = time.Now().Add(duration)
+}
@@ -0,0 +1,113 @@
+package CM
+
+import (
+	"fmt"
+	"ivy/message"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Records a heartbeat from the client
+func (cm *CentralManager) heartbeat(clientID int) {
+	cm.Lock.Lock()
+	defer cm.Lock.Unlock()
+	cm.LastSeen[clientID] = time.Now()
+}
+
+// Checks that the client is still a member. An id that was handed out by this metadata but is no longer in
+// the membership table belongs to a client that was evicted or left, while unknown ids are let through since
+// a central manager that lost its metadata has to hear from the clients to recover it.
+func (cm *CentralManager) isMember(clientID int, ip string) bool {
+	cm.Lock.Lock()
+	defer cm.Lock.Unlock()
+	if cm.NumShards > 0 && cm.Shard != 0 {
+		return true // In fixed mode only the first central manager keeps the members
+	}
+	member, ok := cm.Members[clientID]
+	if !ok {
+		return clientID >= cm.NextID
+	}
+	return member == ip
+}
+
+// Drops the client from the liveness table once it is no longer a member
+func (cm *CentralManager) forget(clientID int) {
+	cm.Lock.Lock()
+	defer cm.Lock.Unlock()
+	delete(cm.LastSeen, clientID)
+}
+
+// Checks if the client has sent a heartbeat within ClientTimeout.
+// Clients that have never been heard from, and every client while this central manager has only just become active, count as alive.
+func (cm *CentralManager) alive(clientID int) bool {
+	cm.Lock.Lock()
+	defer cm.Lock.Unlock()
+	if time.Since(cm.activeSince) < cm.ClientTimeout {
+		return true
+	}
+	seen, ok := cm.LastSeen[clientID]
+	return !ok || time.Since(seen) <= cm.ClientTimeout
+}
+
+// Returns when the client stops using its cache if no heartbeat of it gets through from now on.
+// The client times ClientTimeout from when it sent the last heartbeat answered, so timing it from when it arrived is on the safe side.
+// A central manager that has just become active has not heard from the clients yet, it gives them ClientTimeout from then.
+func (cm *CentralManager) silentBy(clientID int) time.Time {
+	cm.Lock.Lock()
+	defer cm.Lock.Unlock()
+	last := cm.activeSince
+	if seen, ok := cm.LastSeen[clientID]; ok && seen.After(last) {
+		last = seen
+	}
+	silent := last.Add(cm.ClientTimeout)
+	if evicted := cm.silences[clientID]; evicted.After(silent) {
+		silent = evicted // Already evicted, the heartbeats it sent before are forgotten
+	}
+	cm.silences[clientID] = silent
+	return silent
+}
+
+// Calls the client unless it has stopped sending heartbeats, in which case it fails right away like an unreachable client
+func (cm *CentralManager) callClient(client Pointer, msg message.Message) (message.Message, error) {
+	if !cm.alive(client.ID) {
+		return message.Message{}, fmt.Errorf("no heartbeat from client %d for over %s", client.ID, cm.ClientTimeout)
+	}
+	return cm.call(client.IP, "Client.ReceiveRequest", msg)
+}
+
+// Returns a copy of the liveness table, must be called with the lock held
+func (cm *CentralManager) liveness() map[int]time.Time {
+	lastSeen := make(map[int]time.Time, len(cm.LastSeen))
+	for id, seen := range cm.LastSeen {
+		lastSeen[id] = seen
+	}
+	return lastSeen
+}
+
+// Describes when every member was last heard from, for the menu
+func (cm *CentralManager) Liveness() string {
+	cm.Lock.Lock()
+	ids := make([]int, 0, len(cm.Members))
+	for id := range cm.Members {
+		ids = append(ids, id)
+	}
+	lastSeen := cm.liveness()
+	cm.Lock.Unlock()
+	sort.Ints(ids)
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "Client liveness (timeout %s):\n", cm.ClientTimeout)
+	for _, id := range ids {
+		seen, ok := lastSeen[id]
+		switch {
+		case !ok:
+			fmt.Fprintf(&b, "ClientID: %d, never heard from\n", id)
+		case cm.alive(id):
+			fmt.Fprintf(&b, "ClientID: %d, alive, last seen %s ago\n", id, time.Since(seen).Round(time.Millisecond))
+		default:
+			fmt.Fprintf(&b, "ClientID: %d, dead, last seen %s ago\n", id, time.Since(seen).Round(time.Millisecond))
+		}
+	}
+	return b.String()
+}
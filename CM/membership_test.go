@@ -0,0 +1,109 @@
+package CM
+
+import (
+	"errors"
+	"ivy/client"
+	"ivy/utils"
+	"testing"
+)
+
+// Hands the pages over to a client that has gone away without leaving
+func handToGhost(cm *CentralManager, ghost Pointer, pageIDs ...int) {
+	cm.Lock.Lock()
+	defer cm.Lock.Unlock()
+	cm.Members[ghost.ID] = ghost.IP
+	for _, pageID := range pageIDs {
+		record := cm.Records[pageID]
+		record.Owner = ghost
+		cm.Records[pageID] = record
+	}
+}
+
+func TestEvictUnreachableOwner(t *testing.T) {
+	mem := utils.NewMemory()
+	cfg := testConfig()
+	cfg.Primary = "10.0.7.1:7000"
+	cfg.Backup = ""
+	cm := NewCentralManager(cfg.Primary, cfg)
+	cm.UseTransport(mem)
+	serve(t, cm)
+
+	writer := openClient(t, cfg, mem, "10.0.7.2")
+	reader := openClient(t, cfg, mem, "10.0.7.3")
+	other := openClient(t, cfg, mem, "10.0.7.4")
+	if err := writer.Write(0, []byte("A")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := reader.Read(0, 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := writer.Write(cfg.PageSize, []byte("B")); err != nil {
+		t.Fatal(err)
+	}
+	ghost := Pointer{ID: 100, IP: "10.0.7.9:7000"}
+	handToGhost(cm, ghost, 0, 1)
+
+	// The owner cannot be reached, so the copyholder takes over the page and serves it
+	data, err := other.Read(0, 1)
+	if err != nil || string(data) != "A" {
+		t.Fatalf("read of a page whose owner is gone: %q %v, want the copy", data, err)
+	}
+	if record, _ := recordOf(cm, 0); record.Owner.ID != reader.ID {
+		t.Errorf("page 0 is owned by client %d, want the copyholder %d", record.Owner.ID, reader.ID)
+	}
+	cm.Lock.Lock()
+	_, member := cm.Members[ghost.ID]
+	cm.Lock.Unlock()
+	if member {
+		t.Errorf("the unreachable client is still a member")
+	}
+
+	// Nobody else had the other page
+	_, err = other.Read(cfg.PageSize, 1)
+	if !errors.Is(err, client.ErrPageLost) {
+		t.Fatalf("read of a page that only the evicted client had: %v, want ErrPageLost", err)
+	}
+}
+
+func TestLeaveHandsPagesBack(t *testing.T) {
+	mem := utils.NewMemory()
+	cfg := testConfig()
+	cfg.Primary = "10.0.7.5:7000"
+	cfg.Backup = ""
+	cm := NewCentralManager(cfg.Primary, cfg)
+	cm.UseTransport(mem)
+	serve(t, cm)
+
+	leaver := openClient(t, cfg, mem, "10.0.7.6")
+	reader := openClient(t, cfg, mem, "10.0.7.7")
+	if err := leaver.Write(0, []byte("A")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := reader.Read(0, 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := leaver.Write(cfg.PageSize, []byte("B")); err != nil {
+		t.Fatal(err)
+	}
+	if err := leaver.Leave(); err != nil {
+		t.Fatalf("leaving: %s", err)
+	}
+
+	// The copyholder owns the page now, and the central manager kept the page nobody else had
+	if record, _ := recordOf(cm, 0); record.Owner.ID != reader.ID {
+		t.Errorf("page 0 is owned by client %d, want the copyholder %d", record.Owner.ID, reader.ID)
+	}
+	cm.Lock.Lock()
+	_, member := cm.Members[leaver.ID]
+	cm.Lock.Unlock()
+	if member {
+		t.Errorf("the client that left is still a member")
+	}
+	data, err := reader.Read(cfg.PageSize, 1)
+	if err != nil || string(data) != "B" {
+		t.Fatalf("read of the page handed back: %q %v", data, err)
+	}
+	if _, err := leaver.Read(0, 1); !errors.Is(err, client.ErrLeft) {
+		t.Errorf("read after leaving: %v, want ErrLeft", err)
+	}
+}
@@ -0,0 +1,271 @@
+package CM
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+)
+
+const (
+	SET_RECORD = "SET_RECORD" // Replace the record of a page
+	ADD_COPY   = "ADD_COPY"   // Add a copyholder to the record of a page
+	ENQUEUE    = "ENQUEUE"    // Push a READ or WRITE onto the queue of its page
+	COMPLETE   = "COMPLETE"   // Mark a READ or WRITE as no longer in flight
+	JOIN       = "JOIN"       // Add a client to the membership table
+	LEAVE      = "LEAVE"      // Remove a client from the membership table and the records, handing its pages over
+	EVICT      = "EVICT"      // Remove a dead client from the membership table and the records
+	STORE_PAGE = "STORE_PAGE" // Replace the replica of a page with the contents pushed by its owner
+	TAKEOVER   = "TAKEOVER"   // Drop the requests in flight, committed by a new primary or raft leader
+)
+
+// Mutation is a single change to the central manager metadata.
+// Every change to the records, the page queues and the membership table goes through commit as a Mutation,
+// so that it can be replicated before it takes effect.
+type Mutation struct {
+	Op       string
+	PageID   int
+	Record   Record         // Used by SET_RECORD
+	Pointer  Pointer        // Used by ADD_COPY, JOIN, LEAVE, EVICT and STORE_PAGE
+	Request  Request        // Used by ENQUEUE and COMPLETE, and by EVICT for the request being served when the client was found dead
+	Data     []byte         // Used by STORE_PAGE
+	Contents map[int][]byte // Used by LEAVE, contents of the pages held by the client that is leaving
+}
+
+// Outcome of applying a Mutation
+type result struct {
+	Started   []Request // Requests that may now be served, for ENQUEUE, COMPLETE, LEAVE and EVICT
+	Record    Record    // Record of the page after ADD_COPY and EVICT
+	ClientID  int       // Id handed out by JOIN
+	Duplicate bool      // Set by ENQUEUE when the request is already queued or in flight
+	Err       string    // Set when the mutation was rejected, e.g. PAGE_NOT_FOUND or PAGE_LOST
+}
+
+// Commits the mutation and applies it to the metadata.
+// With raft replication the mutation only takes effect once a majority of the replicas have it in their log,
+// otherwise it is written to the write-ahead log, if there is one, and the active central manager ships it
+// to the backups and waits for their acks before returning. A backup standing by commits nothing.
+func (cm *CentralManager) commit(m Mutation) (result, error) {
+	if cm.raft != nil {
+		return cm.raft.propose(m)
+	}
+	cm.shipLock.Lock()
+	defer cm.shipLock.Unlock()
+
+	cm.Lock.Lock()
+	if cm.IsBackup && !cm.isDead {
+		cm.Lock.Unlock()
+		return result{}, errors.New(STALE_EPOCH + ": this central manager is standing by") // E.g. handed back while the request was being served
+	}
+	msg := ShipMessage{Seq: cm.Seq + 1, Epoch: cm.Epoch, Mutation: m}
+	if err := cm.store.append(msg); err != nil {
+		cm.Lock.Unlock()
+		return result{}, err
+	}
+	res := cm.apply(m)
+	cm.Seq = msg.Seq
+	cm.Lock.Unlock()
+
+	if err := cm.ship(msg); err != nil {
+		return result{}, err
+	}
+	cm.Lock.Lock()
+	cm.shipped = msg.Seq
+	cm.Lock.Unlock()
+	return res, nil
+}
+
+// Applies the mutation to the metadata, must be called with the lock held.
+// It has to be deterministic since every raft replica applies the same mutations in the same order.
+func (cm *CentralManager) apply(m Mutation) result {
+	switch m.Op {
+	case SET_RECORD:
+		cm.Records[m.PageID] = m.Record
+		if !cm.ReplicatePages {
+			delete(cm.PageData, m.PageID) // Handed back by a client that left, the new owner has it now and will change it
+		}
+	case ADD_COPY:
+		record, ok := cm.Records[m.PageID]
+		if !ok {
+			if _, ok := cm.PageData[m.PageID]; ok {
+				// Only the replica is left, the reader gets it from the central manager and becomes the owner
+				record = Record{Copies: []Pointer{}, Owner: m.Pointer}
+				cm.Records[m.PageID] = record
+				return result{Record: record}
+			}
+			return result{Err: cm.missing(m.PageID)}
+		}
+		record.Copies = append(record.Copies, m.Pointer)
+		cm.Records[m.PageID] = record
+		return result{Record: record}
+	case ENQUEUE:
+		// A WRITE for a page that does not exist yet creates it, a READ for it fails unless a WRITE is already on its way
+		pageID := m.Request.PageID
+		if cm.Lost[pageID] {
+			return result{Err: PAGE_LOST}
+		}
+		_, ok := cm.Records[pageID]
+		_, replicated := cm.PageData[pageID]
+		if m.Request.Type == READ && !ok && !replicated && !cm.hasQueued(pageID, WRITE) && !cm.Transitions[pageID].Writing {
+			return result{Err: PAGE_NOT_FOUND}
+		}
+		if m.Request.ID != "" {
+			if _, ok := cm.Pending[m.Request.ID]; ok {
+				return result{Duplicate: true}
+			}
+			cm.Pending[m.Request.ID] = m.Request
+		}
+		cm.Queues[pageID] = append(cm.Queues[pageID], m.Request)
+		return result{Started: cm.advance(pageID)}
+	case COMPLETE:
+		if m.Request.ID != "" {
+			if _, ok := cm.Pending[m.Request.ID]; !ok {
+				return result{} // Already completed, e.g. when its client was evicted
+			}
+			delete(cm.Pending, m.Request.ID)
+		}
+		cm.finish(m.Request)
+		return result{Started: cm.advance(m.Request.PageID)}
+	case JOIN:
+		for id, ip := range cm.Members {
+			if ip == m.Pointer.IP {
+				return result{ClientID: id} // The client is rejoining, e.g. after retrying against another central manager
+			}
+		}
+		id := cm.NextID
+		cm.NextID++
+		cm.Members[id] = m.Pointer.IP
+		return result{ClientID: id}
+	case LEAVE:
+		return result{Started: cm.remove(m.Pointer, m.Contents, Request{})}
+	case EVICT:
+		return cm.evict(m)
+	case STORE_PAGE:
+		if record, ok := cm.Records[m.PageID]; !ok || record.Owner.ID != m.Pointer.ID {
+			return result{Err: fmt.Sprintf("client %d does not own page %d", m.Pointer.ID, m.PageID)}
+		}
+		cm.PageData[m.PageID] = m.Data
+	case TAKEOVER:
+		// The clients retry their pending requests when told about the new leader, so nobody waits on these anymore
+		cm.Queues = make(map[int][]Request)
+		cm.Transitions = make(map[int]Transition)
+		cm.Pending = make(map[string]Request)
+	default:
+		return result{Err: fmt.Sprintf("unknown mutation %s", m.Op)}
+	}
+	return result{}
+}
+
+// Removes a dead client from the membership table and the records, must be called with the lock held.
+// Returns the record of m.PageID, the page of the request being served when the client was found dead.
+func (cm *CentralManager) evict(m Mutation) result {
+	started := cm.remove(m.Pointer, nil, m.Request)
+	if record, ok := cm.Records[m.PageID]; ok {
+		return result{Record: record, Started: started}
+	}
+	if _, ok := cm.PageData[m.PageID]; ok {
+		if m.Request.Type == WRITE {
+			return result{Started: started} // The writer starts from the replica and becomes the owner on its WRITE_CONFIRMATION
+		}
+		// Served from the replica, the reader becomes the owner
+		record := Record{Copies: []Pointer{}, Owner: m.Request.From}
+		cm.Records[m.PageID] = record
+		return result{Record: record, Started: started}
+	}
+	return result{Err: cm.missing(m.PageID), Started: started}
+}
+
+// Removes a client from the membership table and the records, must be called with the lock held.
+// Every page it owned goes to its first copyholder, unless the copies are being invalidated for a WRITE
+// or the only copyholder is the reader of pending, who does not have the page yet. Otherwise the page
+// is kept by the central manager with the contents handed back by the client, or with its replica if
+// there is one, or it is marked lost.
+// The requests of the client that are still queued or in flight are dropped, since it will never confirm them,
+// and the requests that may start in their place are returned.
+func (cm *CentralManager) remove(client Pointer, contents map[int][]byte, pending Request) []Request {
+	delete(cm.Members, client.ID)
+	var pages []int
+	for id, request := range cm.Pending {
+		if request.From.ID != client.ID {
+			continue
+		}
+		delete(cm.Pending, id)
+		if !cm.dequeue(request) {
+			cm.finish(request)
+		}
+		pages = append(pages, request.PageID)
+	}
+	sort.Ints(pages) // Map order is random but every replica has to start the same requests
+	var started []Request
+	for i, pageID := range pages {
+		if i == 0 || pageID != pages[i-1] {
+			started = append(started, cm.advance(pageID)...)
+		}
+	}
+
+	for pageID, record := range cm.Records {
+		copies := []Pointer{}
+		for _, copy := range record.Copies {
+			if copy.ID != client.ID {
+				copies = append(copies, copy)
+			}
+		}
+		record.Copies = copies
+
+		if record.Owner.ID == client.ID {
+			promoted := -1
+			if !cm.Transitions[pageID].Writing {
+				for i, copy := range copies {
+					if pending.Type == "" || pageID != pending.PageID || copy.ID != pending.From.ID {
+						promoted = i
+						break
+					}
+				}
+			}
+			if promoted == -1 {
+				delete(cm.Records, pageID)
+				if data, ok := contents[pageID]; ok {
+					cm.PageData[pageID] = data
+				} else if _, ok := cm.PageData[pageID]; !ok {
+					cm.Lost[pageID] = true
+				}
+				continue
+			}
+			record.Owner = copies[promoted]
+			record.Copies = append(copies[:promoted:promoted], copies[promoted+1:]...)
+		}
+		cm.Records[pageID] = record
+	}
+	return started
+}
+
+// Takes a request that is no longer in flight off the transition of its page, must be called with the lock held
+func (cm *CentralManager) finish(request Request) {
+	transition := cm.Transitions[request.PageID]
+	if request.Type == WRITE {
+		transition.Writing = false
+	} else if transition.Readers > 0 {
+		transition.Readers--
+	}
+	cm.Transitions[request.PageID] = transition
+}
+
+// Drops a request from the queue of its page, must be called with the lock held.
+// Returns false if the request is not queued, i.e. it is in flight.
+func (cm *CentralManager) dequeue(request Request) bool {
+	queue := cm.Queues[request.PageID]
+	for i, queued := range queue {
+		if queued.ID == request.ID {
+			cm.Queues[request.PageID] = append(queue[:i:i], queue[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// Reason a page has no record, must be called with the lock held
+func (cm *CentralManager) missing(pageID int) string {
+	if cm.Lost[pageID] {
+		return PAGE_LOST
+	}
+	return PAGE_NOT_FOUND
+}
@@ -0,0 +1,33 @@
+package CM
+
+type LogEntry struct {
+	Term     int
+	Mutation Mutation
+}
+
+type VoteRequest struct {
+	Term         int
+	CandidateID  int
+	LastLogIndex int
+	LastLogTerm  int
+}
+
+type VoteReply struct {
+	Term        int
+	VoteGranted bool
+}
+
+type AppendRequest struct {
+	Term         int
+	LeaderID     int
+	PrevLogIndex int
+	PrevLogTerm  int
+	Entries      []LogEntry
+	LeaderCommit int
+}
+
+type AppendReply struct {
+	Term          int
+	Success       bool
+	ConflictIndex int // Where the leader should retry from when Success is false
+}
@@ -0,0 +1,147 @@
+package CM
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// On-disk copy of the raft state of a replica.
+// The current term and vote are rewritten whenever they change, and the log is appended to as it grows
+// and rewritten when a leader overwrites part of it, all flushed to disk before the replica answers anyone.
+type raftStore struct {
+	dir string
+	log *os.File
+}
+
+// Raft state that has to survive a restart, besides the log
+type raftState struct {
+	CurrentTerm int
+	VotedFor    int
+}
+
+const (
+	RAFT_STATE_FILE = "raft-state.json"
+	RAFT_LOG_FILE   = "raft-log.jsonl"
+)
+
+// Opens the raft store in dir, returning the saved state and the log entries after the sentinel
+func openRaftStore(dir string) (*raftStore, raftState, []LogEntry, error) {
+	state := raftState{VotedFor: -1}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, state, nil, fmt.Errorf("error creating data directory %s: %s", dir, err)
+	}
+
+	data, err := os.ReadFile(filepath.Join(dir, RAFT_STATE_FILE))
+	if err == nil {
+		err = json.Unmarshal(data, &state)
+	}
+	if err != nil && !os.IsNotExist(err) {
+		return nil, state, nil, fmt.Errorf("error reading raft state in %s: %s", dir, err)
+	}
+
+	log, err := os.OpenFile(filepath.Join(dir, RAFT_LOG_FILE), os.O_CREATE|os.O_RDWR|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, state, nil, fmt.Errorf("error opening raft log in %s: %s", dir, err)
+	}
+	var entries []LogEntry
+	scanner := bufio.NewScanner(log)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		var entry LogEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			break // A torn write from a crash, the entry was never acknowledged
+		}
+		entries = append(entries, entry)
+	}
+	return &raftStore{dir: dir, log: log}, state, entries, nil
+}
+
+// Replaces the saved term and vote
+func (s *raftStore) saveState(state raftState) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	if err := writeFile(filepath.Join(s.dir, RAFT_STATE_FILE), data); err != nil {
+		return fmt.Errorf("error writing raft state: %s", err)
+	}
+	return nil
+}
+
+// Appends the entries to the saved log and flushes it to disk
+func (s *raftStore) appendLog(entries []LogEntry) error {
+	var data []byte
+	for _, entry := range entries {
+		line, err := json.Marshal(entry)
+		if err != nil {
+			return err
+		}
+		data = append(append(data, line...), '\n')
+	}
+	if _, err := s.log.Write(data); err != nil {
+		return fmt.Errorf("error writing to the raft log: %s", err)
+	}
+	return s.log.Sync()
+}
+
+// Replaces the saved log with the entries, for when a leader has overwritten part of it
+func (s *raftStore) rewriteLog(entries []LogEntry) error {
+	tmp := filepath.Join(s.dir, RAFT_LOG_FILE+".tmp")
+	log, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_RDWR|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("error rewriting the raft log: %s", err)
+	}
+	s.log.Close()
+	s.log = log
+	if err := s.appendLog(entries); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, filepath.Join(s.dir, RAFT_LOG_FILE)); err != nil {
+		return fmt.Errorf("error rewriting the raft log: %s", err)
+	}
+	return syncDir(s.dir)
+}
+
+func (s *raftStore) close() {
+	if s != nil {
+		s.log.Close()
+	}
+}
+
+// Writes data to path through a temporary file, so that a crash leaves either the old or the new contents.
+// Returns once both the contents and the rename are on disk.
+func writeFile(path string, data []byte) error {
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(path))
+}
+
+// Flushes the entries of the directory to disk, so that a file renamed into it survives a crash
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
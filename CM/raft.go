@@ -0,0 +1,550 @@
+package CM
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"ivy/message"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+const (
+	FOLLOWER   = "FOLLOWER"
+	CANDIDATE  = "CANDIDATE"
+	LEADER     = "LEADER"
+	NOT_LEADER = "this central manager is not the raft leader"
+)
+
+// Raft replication of the central manager metadata.
+// Every replica runs a CentralManager and they elect a leader among themselves. Only the leader serves the clients,
+// and every Mutation it commits is appended to the replicated log and applied once a majority of the replicas have it.
+// With a DataDir the term, the vote and the log are flushed to disk before a replica answers a candidate or a leader
+// and before a leader counts its own log entries, otherwise they are kept in memory only.
+type raftNode struct {
+	cm          *CentralManager
+	Peers       []string // Addresses of every replica, including this one
+	Me          int      // Index of this replica in Peers
+	Role        string   // FOLLOWER | CANDIDATE | LEADER
+	CurrentTerm int
+	VotedFor    int        // Replica voted for in CurrentTerm, -1 if none
+	Log         []LogEntry // Log[0] is a sentinel so that real entries start at index 1
+	CommitIndex int
+	LastApplied int
+	Leader      int // Index of the current leader, -1 if unknown
+
+	nextIndex     []int // Leader only, next log index to send to each replica
+	matchIndex    []int // Leader only, highest log index known to be replicated on each replica
+	votes         int   // Candidate only, votes received in CurrentTerm
+	lastContact   time.Time
+	lastBroadcast time.Time
+
+	baseElectionTimeout time.Duration
+	electionTimeout     time.Duration // Randomized between baseElectionTimeout and twice that for every election
+	heartbeat           time.Duration
+	commitTimeout       time.Duration
+	waiters             map[int]waiter // Map of log index to the proposer waiting for that entry to be applied
+	store               *raftStore     // Raft state on disk, nil when it is only kept in memory
+	saved               raftState      // Term and vote last written to the store
+	savedLen            int            // Number of entries of Log written to the store, the sentinel included
+	rewrite             bool           // Set when an entry already in the store has been overwritten
+	lock                sync.Mutex
+}
+
+// Proposer waiting for its entry to be applied
+type waiter struct {
+	term int // Term the entry was proposed in, if another entry ends up at the index leadership was lost
+	ch   chan commitResult
+}
+
+type commitResult struct {
+	res result
+	err error
+}
+
+func newRaftNode(cm *CentralManager, peers []string, me int, electionTimeout time.Duration, heartbeat time.Duration, commitTimeout time.Duration) *raftNode {
+	r := &raftNode{
+		cm:                  cm,
+		Peers:               peers,
+		Me:                  me,
+		Role:                FOLLOWER,
+		VotedFor:            -1,
+		Log:                 []LogEntry{{Term: 0}},
+		Leader:              -1,
+		lastContact:         time.Now(),
+		baseElectionTimeout: electionTimeout,
+		heartbeat:           heartbeat,
+		commitTimeout:       commitTimeout,
+		waiters:             make(map[int]waiter),
+		saved:               raftState{VotedFor: -1},
+		savedLen:            1,
+	}
+	r.resetElectionTimeout()
+	return r
+}
+
+// Function to run the raft election and heartbeat timers
+func (cm *CentralManager) StartRaft() {
+	r := cm.raft
+	for {
+		time.Sleep(r.heartbeat / 4)
+		if cm.rebooting() {
+			continue // Neither sends heartbeats nor starts elections while down
+		}
+
+		r.lock.Lock()
+		if r.Role == LEADER {
+			due := time.Since(r.lastBroadcast) >= r.heartbeat
+			r.lock.Unlock()
+			if due {
+				r.broadcast()
+			}
+			continue
+		}
+		timedOut := time.Since(r.lastContact) >= r.electionTimeout
+		r.lock.Unlock()
+
+		if timedOut {
+			r.startElection()
+		}
+	}
+}
+
+// Appends the mutation to the log and blocks until it is committed and applied
+func (r *raftNode) propose(m Mutation) (result, error) {
+	r.lock.Lock()
+	if r.Role != LEADER {
+		err := r.notLeader()
+		r.lock.Unlock()
+		return result{}, err
+	}
+	index := len(r.Log)
+	r.Log = append(r.Log, LogEntry{Term: r.CurrentTerm, Mutation: m})
+	ch := make(chan commitResult, 1)
+	r.waiters[index] = waiter{term: r.CurrentTerm, ch: ch}
+	r.advanceCommit() // Commits right away when running alone
+	r.lock.Unlock()
+
+	r.broadcast()
+
+	select {
+	case committed := <-ch:
+		return committed.res, committed.err
+	case <-time.After(r.commitTimeout):
+		r.lock.Lock()
+		delete(r.waiters, index)
+		r.lock.Unlock()
+		return result{}, fmt.Errorf("timed out committing %s to the raft log", m.Op)
+	}
+}
+
+// Builds the error returned to clients that reached a replica which is not the leader, must be called with the lock held
+func (r *raftNode) notLeader() error {
+	if r.Leader >= 0 {
+		return fmt.Errorf("%s, the leader is %s", NOT_LEADER, r.Peers[r.Leader])
+	}
+	return errors.New(NOT_LEADER)
+}
+
+// Returns the error for clients that reached a replica which is not the leader, nil on the leader and without raft.
+// Only the leader moves to the epoch of its term, so the epoch of the clients tells nothing to the other replicas.
+func (r *raftNode) checkLeader() error {
+	if r == nil {
+		return nil
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.Role != LEADER {
+		return r.notLeader()
+	}
+	return nil
+}
+
+func (r *raftNode) resetElectionTimeout() {
+	r.electionTimeout = r.baseElectionTimeout + time.Duration(rand.Int63n(int64(r.baseElectionTimeout)))
+}
+
+func (r *raftNode) lastLog() (int, int) {
+	index := len(r.Log) - 1
+	return index, r.Log[index].Term
+}
+
+// Writes the term, the vote and the log entries that changed since the last call to the store, must be called with the lock held
+func (r *raftNode) persist() error {
+	if r.store == nil {
+		return nil
+	}
+	state := raftState{CurrentTerm: r.CurrentTerm, VotedFor: r.VotedFor}
+	if state != r.saved {
+		if err := r.store.saveState(state); err != nil {
+			return err
+		}
+		r.saved = state
+	}
+	if r.rewrite || len(r.Log) < r.savedLen {
+		if err := r.store.rewriteLog(r.Log[1:]); err != nil {
+			return err
+		}
+		r.rewrite = false
+	} else if len(r.Log) > r.savedLen {
+		if err := r.store.appendLog(r.Log[r.savedLen:]); err != nil {
+			r.rewrite = true // Part of the entries may have made it to disk
+			return err
+		}
+	}
+	r.savedLen = len(r.Log)
+	return nil
+}
+
+// Loads the term, the vote and the log from the store in dir and keeps saving them there.
+// Nothing has been applied yet, the metadata is rebuilt as the leader tells this replica which entries are committed.
+func (r *raftNode) restore(dir string) error {
+	s, state, entries, err := openRaftStore(dir)
+	if err != nil {
+		return err
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.store.close()
+	r.store = s
+	r.CurrentTerm = state.CurrentTerm
+	r.VotedFor = state.VotedFor
+	r.Log = append([]LogEntry{{Term: 0}}, entries...)
+	r.CommitIndex = 0
+	r.LastApplied = 0
+	r.saved = state
+	r.savedLen = len(r.Log)
+	r.rewrite = false
+	fmt.Printf("[CENTRAL-MANAGER] Restored raft term %d and %d log entries from %s\n", r.CurrentTerm, len(entries), dir)
+	return nil
+}
+
+// Drops the raft state kept in memory, as a replica that has stopped would, until restore loads it from the store
+func (r *raftNode) forget() {
+	if r == nil {
+		return
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.store.close()
+	r.store = nil
+	r.Role = FOLLOWER
+	r.CurrentTerm = 0
+	r.VotedFor = -1
+	r.Log = []LogEntry{{Term: 0}}
+	r.CommitIndex = 0
+	r.LastApplied = 0
+	r.Leader = -1
+	for index, w := range r.waiters {
+		delete(r.waiters, index)
+		w.ch <- commitResult{err: errors.New("the raft replica stopped before the mutation was committed")}
+	}
+	r.lastContact = time.Now()
+}
+
+// Steps down to follower in the given term, must be called with the lock held
+func (r *raftNode) becomeFollower(term int) {
+	if term > r.CurrentTerm {
+		r.CurrentTerm = term
+		r.VotedFor = -1
+	}
+	if r.Role != FOLLOWER {
+		fmt.Printf("[CENTRAL-MANAGER] Stepping down to raft follower in term %d\n", r.CurrentTerm)
+	}
+	r.Role = FOLLOWER
+}
+
+// Becomes a candidate and asks every other replica for its vote
+func (r *raftNode) startElection() {
+	r.lock.Lock()
+	r.Role = CANDIDATE
+	r.CurrentTerm++
+	r.VotedFor = r.Me
+	r.votes = 1
+	r.Leader = -1
+	r.lastContact = time.Now()
+	r.resetElectionTimeout()
+	lastIndex, lastTerm := r.lastLog()
+	args := VoteRequest{Term: r.CurrentTerm, CandidateID: r.Me, LastLogIndex: lastIndex, LastLogTerm: lastTerm}
+	if err := r.persist(); err != nil {
+		fmt.Printf("[CENTRAL-MANAGER] Error occurred while saving the raft state, not starting the election: %s\n", err)
+		r.lock.Unlock()
+		return
+	}
+	fmt.Printf("[CENTRAL-MANAGER] Starting raft election for term %d\n", r.CurrentTerm)
+	if r.votes*2 > len(r.Peers) {
+		r.becomeLeader()
+	}
+	r.lock.Unlock()
+
+	for i, peer := range r.Peers {
+		if i == r.Me {
+			continue
+		}
+		go func() {
+			var reply VoteReply
+			if err := r.call(peer, "CentralManager.RequestVote", args, &reply); err != nil {
+				return
+			}
+			r.lock.Lock()
+			defer r.lock.Unlock()
+			if reply.Term > r.CurrentTerm {
+				r.becomeFollower(reply.Term)
+				return
+			}
+			if r.Role != CANDIDATE || r.CurrentTerm != args.Term || !reply.VoteGranted {
+				return
+			}
+			r.votes++
+			if r.votes*2 > len(r.Peers) {
+				r.becomeLeader()
+			}
+		}()
+	}
+}
+
+// Takes over as leader, must be called with the lock held
+func (r *raftNode) becomeLeader() {
+	fmt.Printf("[CENTRAL-MANAGER] Elected raft leader for term %d\n", r.CurrentTerm)
+	r.Role = LEADER
+	r.Leader = r.Me
+	r.cm.Lock.Lock()
+	r.cm.Epoch = r.CurrentTerm // The term doubles as the epoch handed to the clients
+	r.cm.Lock.Unlock()
+	r.nextIndex = make([]int, len(r.Peers))
+	r.matchIndex = make([]int, len(r.Peers))
+	for i := range r.Peers {
+		r.nextIndex[i] = len(r.Log)
+	}
+	// Entries from earlier terms only count as committed once an entry from this term is
+	r.Log = append(r.Log, LogEntry{Term: r.CurrentTerm, Mutation: Mutation{Op: TAKEOVER}})
+	r.advanceCommit()
+
+	go r.broadcast()
+	go func() {
+		var reply message.Message
+		r.cm.DeclareCM(message.Message{}, &reply)
+	}()
+}
+
+// Sends AppendEntries, or a heartbeat when there is nothing new, to every other replica
+func (r *raftNode) broadcast() {
+	r.lock.Lock()
+	if r.Role != LEADER {
+		r.lock.Unlock()
+		return
+	}
+	r.lastBroadcast = time.Now()
+	requests := make(map[int]AppendRequest)
+	for i := range r.Peers {
+		if i == r.Me {
+			continue
+		}
+		prev := r.nextIndex[i] - 1
+		requests[i] = AppendRequest{
+			Term:         r.CurrentTerm,
+			LeaderID:     r.Me,
+			PrevLogIndex: prev,
+			PrevLogTerm:  r.Log[prev].Term,
+			Entries:      append([]LogEntry{}, r.Log[prev+1:]...),
+			LeaderCommit: r.CommitIndex,
+		}
+	}
+	r.lock.Unlock()
+
+	for i, args := range requests {
+		go r.sendAppend(i, args)
+	}
+}
+
+func (r *raftNode) sendAppend(peer int, args AppendRequest) {
+	var reply AppendReply
+	if err := r.call(r.Peers[peer], "CentralManager.AppendEntries", args, &reply); err != nil {
+		return // Retried with the next heartbeat
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if reply.Term > r.CurrentTerm {
+		r.becomeFollower(reply.Term)
+		return
+	}
+	if r.Role != LEADER || r.CurrentTerm != args.Term {
+		return
+	}
+	if reply.Success {
+		match := args.PrevLogIndex + len(args.Entries)
+		if match > r.matchIndex[peer] {
+			r.matchIndex[peer] = match
+		}
+		r.nextIndex[peer] = r.matchIndex[peer] + 1
+		r.advanceCommit()
+		return
+	}
+	// Back up to where the logs diverge and retry with the next heartbeat
+	r.nextIndex[peer] = max(1, min(reply.ConflictIndex, r.nextIndex[peer]-1))
+}
+
+// Commits the highest entry of the current term stored on a majority of the replicas, must be called with the lock held
+func (r *raftNode) advanceCommit() {
+	if err := r.persist(); err != nil {
+		fmt.Printf("[CENTRAL-MANAGER] Error occurred while saving the raft log: %s\n", err)
+		return // This replica only counts once its own log is on disk
+	}
+	for n := len(r.Log) - 1; n > r.CommitIndex && r.Log[n].Term == r.CurrentTerm; n-- {
+		count := 1
+		for i := range r.Peers {
+			if i != r.Me && r.matchIndex[i] >= n {
+				count++
+			}
+		}
+		if count*2 > len(r.Peers) {
+			r.CommitIndex = n
+			r.applyCommitted()
+			return
+		}
+	}
+}
+
+// Applies the committed entries to the metadata in log order, must be called with the lock held
+func (r *raftNode) applyCommitted() {
+	for r.LastApplied < r.CommitIndex {
+		r.LastApplied++
+		entry := r.Log[r.LastApplied]
+
+		r.cm.Lock.Lock()
+		res := r.cm.apply(entry.Mutation)
+		r.cm.Lock.Unlock()
+
+		if w, ok := r.waiters[r.LastApplied]; ok {
+			delete(r.waiters, r.LastApplied)
+			if w.term != entry.Term {
+				w.ch <- commitResult{err: errors.New("lost raft leadership before the mutation was committed")}
+			} else {
+				w.ch <- commitResult{res: res}
+			}
+		} else if r.Role == LEADER && entry.Term == r.CurrentTerm {
+			// Proposed by this leader but its proposer has given up waiting, so nobody else serves what it started
+			for _, next := range res.Started {
+				go r.cm.dispatch(next)
+			}
+		}
+	}
+}
+
+// Makes an RPC call to another replica over the pooled connection, giving up after an election timeout
+func (r *raftNode) call(ip string, method string, args interface{}, reply interface{}) error {
+	ctx, cancel := context.WithTimeout(context.Background(), r.baseElectionTimeout)
+	defer cancel()
+	err := r.cm.pool.Call(ctx, ip, method, args, reply)
+	if err != nil {
+		return fmt.Errorf("error in calling %s: %s", method, err)
+	}
+	return nil
+}
+
+// RPC called by a candidate to ask for this replica's vote
+func (cm *CentralManager) RequestVote(args VoteRequest, reply *VoteReply) error {
+	r := cm.raft
+	if r == nil {
+		return errors.New("raft replication is not enabled on this central manager")
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.requestVote(args, reply)
+	return r.persist() // The vote only goes out once it is on disk
+}
+
+func (r *raftNode) requestVote(args VoteRequest, reply *VoteReply) {
+	if args.Term > r.CurrentTerm {
+		r.becomeFollower(args.Term)
+	}
+	reply.Term = r.CurrentTerm
+	if args.Term < r.CurrentTerm {
+		return
+	}
+
+	// Only vote for candidates whose log is at least as up to date as ours
+	lastIndex, lastTerm := r.lastLog()
+	upToDate := args.LastLogTerm > lastTerm || (args.LastLogTerm == lastTerm && args.LastLogIndex >= lastIndex)
+	if (r.VotedFor == -1 || r.VotedFor == args.CandidateID) && upToDate {
+		r.VotedFor = args.CandidateID
+		r.lastContact = time.Now()
+		reply.VoteGranted = true
+	}
+}
+
+// RPC called by the leader to replicate log entries, also used as heartbeat
+func (cm *CentralManager) AppendEntries(args AppendRequest, reply *AppendReply) error {
+	r := cm.raft
+	if r == nil {
+		return errors.New("raft replication is not enabled on this central manager")
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.appendEntries(args, reply)
+	return r.persist() // The leader only counts the entries once they are on disk
+}
+
+func (r *raftNode) appendEntries(args AppendRequest, reply *AppendReply) {
+	reply.Term = r.CurrentTerm
+	if args.Term < r.CurrentTerm {
+		return // Stale leader
+	}
+	if args.Term > r.CurrentTerm || r.Role != FOLLOWER {
+		r.becomeFollower(args.Term)
+		reply.Term = r.CurrentTerm
+	}
+	r.Leader = args.LeaderID
+	r.lastContact = time.Now()
+
+	if args.PrevLogIndex >= len(r.Log) {
+		reply.ConflictIndex = len(r.Log)
+		return
+	}
+	if r.Log[args.PrevLogIndex].Term != args.PrevLogTerm {
+		// Skip back over the whole conflicting term at once
+		conflict := args.PrevLogIndex
+		for conflict > 1 && r.Log[conflict-1].Term == r.Log[args.PrevLogIndex].Term {
+			conflict--
+		}
+		reply.ConflictIndex = conflict
+		return
+	}
+
+	for i, entry := range args.Entries {
+		index := args.PrevLogIndex + 1 + i
+		if index < len(r.Log) {
+			if r.Log[index].Term == entry.Term {
+				continue
+			}
+			r.Log = r.Log[:index] // Drop the conflicting entry and everything after it
+			if index < r.savedLen {
+				r.rewrite = true
+			}
+		}
+		r.Log = append(r.Log, entry)
+	}
+
+	if args.LeaderCommit > r.CommitIndex {
+		r.CommitIndex = max(r.CommitIndex, min(args.LeaderCommit, args.PrevLogIndex+len(args.Entries)))
+		r.applyCommitted()
+	}
+	reply.Success = true
+}
+
+// Describes the replication state for the menu
+func (cm *CentralManager) RaftStatus() string {
+	r := cm.raft
+	if r == nil {
+		return "Raft replication is not enabled"
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	leader := "unknown"
+	if r.Leader >= 0 {
+		leader = r.Peers[r.Leader]
+	}
+	return fmt.Sprintf("Role: %s, Term: %d, Leader: %s, Commit index: %d and Log length: %d", r.Role, r.CurrentTerm, leader, r.CommitIndex, len(r.Log)-1)
+}
@@ -0,0 +1,162 @@
+package CM
+
+import (
+	"ivy/utils"
+	"testing"
+	"time"
+)
+
+// Returns the replica that currently leads, nil while there is none
+func leaderOf(replicas []*CentralManager) *CentralManager {
+	for _, cm := range replicas {
+		cm.raft.lock.Lock()
+		leading := cm.raft.Role == LEADER
+		cm.raft.lock.Unlock()
+		if leading && cm.active() {
+			return cm
+		}
+	}
+	return nil
+}
+
+func term(cm *CentralManager) int {
+	cm.raft.lock.Lock()
+	defer cm.raft.lock.Unlock()
+	return cm.raft.CurrentTerm
+}
+
+func TestRaftLeaderChange(t *testing.T) {
+	mem := utils.NewMemory()
+	cfg := testConfig()
+	cfg.Replicas = []string{"10.0.3.1:7000", "10.0.3.2:7000", "10.0.3.3:7000"}
+	var replicas []*CentralManager
+	faults := make(map[string]*utils.Faulty)
+	for _, ip := range cfg.Replicas {
+		cm := NewCentralManager(ip, cfg)
+		faults[ip] = utils.NewFaulty(mem)
+		cm.UseTransport(faults[ip])
+		replicas = append(replicas, cm)
+	}
+	serve(t, replicas...)
+	for _, cm := range replicas {
+		go cm.StartRaft()
+	}
+	waitFor(t, 3*time.Second, "a leader to be elected", func() bool { return leaderOf(replicas) != nil })
+
+	toClients := utils.NewFaulty(mem)
+	writer := openClient(t, cfg, toClients, "10.0.3.4")
+	reader := openClient(t, cfg, toClients, "10.0.3.5")
+	if err := writer.Write(0, []byte("A")); err != nil {
+		t.Fatalf("write to the first leader: %s", err)
+	}
+
+	// Cut the leader off, the other two elect a new one among themselves
+	old := leaderOf(replicas)
+	oldTerm := term(old)
+	var others []*CentralManager
+	for _, cm := range replicas {
+		if cm != old {
+			faults[cm.IP].Cut(old.IP)
+			others = append(others, cm)
+		}
+	}
+	faults[old.IP].Cut(others[0].IP, others[1].IP, writer.IP, reader.IP)
+	toClients.Cut(old.IP)
+	waitFor(t, 3*time.Second, "a new leader to be elected", func() bool { return leaderOf(others) != nil })
+	leader := leaderOf(others)
+	if term(leader) <= oldTerm {
+		t.Errorf("new leader is in term %d, want newer than %d", term(leader), oldTerm)
+	}
+
+	if err := writer.Write(cfg.PageSize, []byte("B")); err != nil {
+		t.Fatalf("write to the new leader: %s", err)
+	}
+	data, err := reader.Read(0, 1)
+	if err != nil || string(data) != "A" {
+		t.Fatalf("read from the new leader: %q %v, want the write made to the first one", data, err)
+	}
+
+	// The old leader steps down and catches up once it can reach the others again
+	for _, cm := range others {
+		faults[cm.IP].Heal(old.IP)
+	}
+	faults[old.IP].Heal(others[0].IP, others[1].IP, writer.IP, reader.IP)
+	waitFor(t, 3*time.Second, "the old leader to catch up", func() bool {
+		_, ok := recordOf(old, 1)
+		return ok && leaderOf([]*CentralManager{old}) == nil
+	})
+}
+
+func TestRaftFollowerRedirects(t *testing.T) {
+	mem := utils.NewMemory()
+	cfg := testConfig()
+	cfg.Replicas = []string{"10.0.5.1:7000", "10.0.5.2:7000", "10.0.5.3:7000"}
+	var replicas []*CentralManager
+	for _, ip := range cfg.Replicas {
+		cm := NewCentralManager(ip, cfg)
+		cm.UseTransport(mem)
+		replicas = append(replicas, cm)
+	}
+	serve(t, replicas...)
+	for _, cm := range replicas {
+		go cm.StartRaft()
+	}
+	waitFor(t, 3*time.Second, "a leader to be elected", func() bool { return leaderOf(replicas) != nil })
+	c := openClient(t, cfg, mem, "10.0.5.4")
+
+	// Point the client at a follower, which sends the request on to the leader it names
+	leader := leaderOf(replicas)
+	for _, cm := range replicas {
+		if cm != leader {
+			c.Lock.Lock()
+			c.ServerIP = cm.IP
+			c.Lock.Unlock()
+			break
+		}
+	}
+	if err := c.Write(0, []byte("A")); err != nil {
+		t.Fatalf("write sent to a follower: %s", err)
+	}
+	if _, ok := recordOf(leader, 0); !ok {
+		t.Errorf("the leader has no record of the page written through a follower")
+	}
+}
+
+func TestRaftReplicatesRecords(t *testing.T) {
+	mem := utils.NewMemory()
+	cfg := testConfig()
+	cfg.Replicas = []string{"10.0.8.1:7000", "10.0.8.2:7000", "10.0.8.3:7000"}
+	var replicas []*CentralManager
+	for _, ip := range cfg.Replicas {
+		cm := NewCentralManager(ip, cfg)
+		cm.UseTransport(mem)
+		replicas = append(replicas, cm)
+	}
+	serve(t, replicas...)
+	for _, cm := range replicas {
+		go cm.StartRaft()
+	}
+	waitFor(t, 3*time.Second, "a leader to be elected", func() bool { return leaderOf(replicas) != nil })
+
+	writer := openClient(t, cfg, mem, "10.0.8.4")
+	reader := openClient(t, cfg, mem, "10.0.8.5")
+	if err := writer.Write(0, []byte("A")); err != nil {
+		t.Fatalf("write: %s", err)
+	}
+	data, err := reader.Read(0, 1)
+	if err != nil || string(data) != "A" {
+		t.Fatalf("read: %q %v", data, err)
+	}
+
+	// Every replica applies the same records, in the term of the leader
+	leader := leaderOf(replicas)
+	for _, cm := range replicas {
+		waitFor(t, 2*time.Second, cm.IP+" to apply the records", func() bool {
+			record, ok := recordOf(cm, 0)
+			return ok && record.Owner.ID == writer.ID && len(record.Copies) == 1 && record.Copies[0].ID == reader.ID
+		})
+		if cm != leader && term(cm) != term(leader) {
+			t.Errorf("%s is in term %d, want the leader's %d", cm.IP, term(cm), term(leader))
+		}
+	}
+}
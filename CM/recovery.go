@@ -0,0 +1,95 @@
+package CM
+
+import (
+	"errors"
+	"fmt"
+	"ivy/message"
+	"sort"
+)
+
+// Rebuilds the metadata from the pages cached by the clients, for when every central manager has lost it.
+// Each client at one of the given addresses or in the membership table is asked for its cached pages.
+// The client holding a page with WRITE permission becomes its owner, otherwise the READ holder with the lowest id does,
+// and the other holders become its copies. The central manager then declares itself to the clients in a new epoch.
+// Pages nobody holds are gone and are created again by the next WRITE.
+func (cm *CentralManager) Recover(clients []string) error {
+	if cm.raft != nil {
+		return errors.New("raft replicas recover from each other")
+	}
+	if cm.NumShards > 0 {
+		return errors.New("recovery is not supported in fixed mode, the clients keep a single epoch for every central manager")
+	}
+
+	cm.Lock.Lock()
+	known := make(map[string]bool)
+	for _, ip := range cm.Members {
+		known[ip] = true
+	}
+	cm.Lock.Unlock()
+	for _, ip := range clients {
+		known[ip] = true
+	}
+
+	members := make(map[int]string)
+	holders := make(map[int][]message.Message) // Map of page id to the reports of the clients holding it
+	epoch := 0
+	for ip := range known {
+		report, err := cm.call(ip, "Client.ReportPages", message.Message{IP: cm.IP})
+		if err != nil {
+			fmt.Printf("[CENTRAL-MANAGER] Client %s did not report its pages, leaving it out: %s\n", ip, err)
+			continue
+		}
+		members[report.ID] = report.IP
+		epoch = max(epoch, report.Epoch)
+		for pageID, permission := range report.Pages {
+			holders[pageID] = append(holders[pageID], message.Message{ID: report.ID, IP: report.IP, Permission: permission})
+		}
+	}
+
+	records := make(map[int]Record)
+	for pageID, reports := range holders {
+		// The WRITE holder comes first, then the READ holders by id
+		sort.Slice(reports, func(i, j int) bool {
+			if (reports[i].Permission == WRITE) != (reports[j].Permission == WRITE) {
+				return reports[i].Permission == WRITE
+			}
+			return reports[i].ID < reports[j].ID
+		})
+		record := Record{Owner: Pointer{ID: reports[0].ID, IP: reports[0].IP}, Copies: []Pointer{}}
+		for _, report := range reports[1:] {
+			if report.Permission == WRITE {
+				fmt.Printf("[CENTRAL-MANAGER] Page %d has more than one WRITE holder, keeping client %d as owner\n", pageID, record.Owner.ID)
+			}
+			record.Copies = append(record.Copies, Pointer{ID: report.ID, IP: report.IP}) // Invalidated by the next WRITE
+		}
+		records[pageID] = record
+	}
+
+	nextID := 0
+	for id := range members {
+		nextID = max(nextID, id+1)
+	}
+
+	cm.shipLock.Lock()
+	cm.Lock.Lock()
+	cm.Records = records
+	cm.Queues = make(map[int][]Request)
+	cm.Transitions = make(map[int]Transition)
+	cm.Members = members
+	cm.Lost = make(map[int]bool) // Whatever the clients hold is all there is now
+	cm.Pending = make(map[string]Request)
+	cm.NextID = max(cm.NextID, nextID)
+	cm.Epoch = max(cm.Epoch, epoch) // DeclareCM moves past every epoch the clients have seen
+	cm.Seq++
+	cm.synced = make(map[string]bool) // The backups get the rebuilt metadata from StartBackup
+	err := cm.store.snapshot(cm.syncMessageLocked())
+	cm.Lock.Unlock()
+	cm.shipLock.Unlock()
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("[CENTRAL-MANAGER] Recovered %d records from %d clients\n", len(records), len(members))
+	var reply message.Message
+	return cm.DeclareCM(message.Message{}, &reply)
+}
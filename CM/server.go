@@ -1,35 +1,94 @@
 package CM
 
 import (
+	"errors"
 	"fmt"
+	"ivy/config"
 	"ivy/message"
 	"ivy/utils"
 	"net"
 	"net/rpc"
 	"os"
+	"slices"
+	"sort"
 	"sync"
 	"time"
 )
 
-var (
-	TotalReadTime float64
-	TotalWriteTime float64
-	count map[string]int = make(map[string]int, 0)
-)
-
 type CentralManager struct {
 	IP      string
+	PrimaryIP string // Address of the primary central manager
+	Backups []string // Addresses of the backup central managers in order of succession
+	Rank int // Position of this central manager in the succession, 0 for the primary and i+1 for Backups[i], -1 if neither
+	BackupInterval time.Duration // Time interval between attempts to resync a backup that has fallen behind
+	HealthCheckInterval time.Duration // Time interval for health check of the primary central manager
+	LeaseDuration time.Duration // How long a lease renewal from the primary lasts
+	SuspicionThreshold int // Number of health checks in a row that must find the lease expired before the backup takes over
+	leaseExpiry time.Time // When the lease of the primary runs out, as seen by the backup
+	holdingLease bool // Set once HoldLease runs, the active central manager then only serves while it holds the lease
+	renewals map[string]time.Time // Map of standby IP to when the last renewal it accepted was sent, as seen by the active central manager
+	leaseLost bool // Set while some standby may have found the lease expired, nothing is served until it is renewed
+	behind bool // Set while this standby may be missing mutations of the active central manager, it does not take over until it is synced
 	Records map[int]Record // Map of page id to record
-	WriteQueue []WriteRequest
+	Members map[int]string // Map of client id to client IP, the clients that joined the network
+	Lost map[int]bool // Pages that died with their owner, requests for them fail with PAGE_LOST
+	PageData map[int][]byte // Map of page id to the replica of its contents, kept when the clients push their writes or hand their pages back
+	ReplicatePages bool // The clients push their writes, so the replicas are kept up to date after the page is taken over
+	LastSeen map[int]time.Time // Map of client id to the time of its last heartbeat
+	silences map[int]time.Time // Map of client id to when it stops using its cache, as found by the evictions waiting for that
+	Pending map[string]Request // Requests queued or in flight by id, a retried request with one of these is not enqueued again
+	ClientTimeout time.Duration // How long a client may go without a heartbeat before it is considered dead
+	activeSince time.Time // When this central manager last became active, clients are not judged before it has had time to hear from them
+	leaseSince time.Time // When this central manager last took over, the standbys cannot have timed out a lease it held before
+	NextID int // Client id handed out to the next client that joins
+	Shard int // Index of this central manager in fixed mode, it manages the pages with page id % NumShards == Shard
+	NumShards int // Number of central managers sharing the pages in fixed mode, 0 when this one manages every page
+	Queues map[int][]Request // Map of page id to the FIFO queue of READ and WRITE requests for that page waiting to be served
+	Transitions map[int]Transition // Map of page id to the requests in flight for that page, pages without any are left out
+	InvalidateTimeout time.Duration // How long a WRITE waits for the INVALIDATE_CONFIRMATIONs of the copies
+	invalidations map[int]*invalidation // Map of page id to the INVALIDATE_CONFIRMATIONs still expected for the WRITE in flight
 	IsBackup bool // To check if this is a backup central manager
 	isDead bool // To check if the primary central manager is down
-	IsRebooting bool // Boolean to represent if the central manager is rebooting
+	IsRebooting bool // Boolean to represent if the central manager is rebooting, guarded by Lock
+	conns map[net.Conn]bool // Connections being served, closed when rebooting since the peers keep them open between calls
+	transport utils.Transport // Carries the RPCs to and from the other nodes
+	pool *utils.Pool // Connections to the other nodes over transport
+	DataDir string // Directory holding the write-ahead log and the snapshots, the metadata is only kept in memory when empty
+	SnapshotInterval time.Duration // Time between snapshots of the metadata
+	store *store // Write-ahead log and snapshots in DataDir, nil when the metadata is only kept in memory
+	raft *raftNode // Raft replication of the metadata, nil when running as primary/backup
+	Seq int // Sequence number of the last mutation committed, shared with the backup
+	shipped int // Sequence number of the last mutation every standby that is up has acked, sent along with the lease
+	synced map[string]bool // Central managers that have every mutation up to Seq, committed mutations are only shipped to these
+	resynced map[string]time.Time // Map of central manager IP to when it was last sent the whole metadata
+	shipLock sync.Mutex // Held while a mutation is committed and shipped, so the backup receives them in order
+	Epoch int // Bumped every time a central manager takes over, the raft term with raft replication
+	fenced bool // Set once a newer epoch has been seen, a fenced central manager does not serve until it is synced again
+	totalReadTime float64 // Sum of the average READ times reported by the clients
+	totalWriteTime float64 // Sum of the average WRITE times reported by the clients
+	reports int // Number of clients that have reported their averages
+	readReports int // Number of reports with an average READ time
+	writeReports int // Number of reports with an average WRITE time
 	Lock sync.Mutex
 }
 
-type WriteRequest struct {
+type Request struct {
+	Type string // READ | WRITE
 	From Pointer
 	PageID int
+	ID string // Request id chosen by the client, empty for clients that do not retry
+}
+
+// Requests in flight for a page
+type Transition struct {
+	Writing bool // A WRITE_FORWARD is in progress, the owner in the record is stale until the WRITE_CONFIRMATION
+	Readers int // Number of READs waiting for their READ_CONFIRMATION
+}
+
+// INVALIDATE_CONFIRMATIONs still expected before a WRITE can be forwarded
+type invalidation struct {
+	pending map[int]bool // Ids of the copyholders that have not confirmed yet
+	done chan struct{} // Closed once every copyholder has confirmed or has been declared failed
 }
 
 type Record struct {
@@ -55,13 +114,90 @@ const (
 	READ_CONFIRMATION = "READ_CONFIRMATION"
 	INVALIDATE_CACHE = "INVALIDATE_CACHE"
 	ACK = "ACK"
-	LOCALHOST = "127.0.0.1:"
-	CENTRALIP = LOCALHOST + "8000"
-	BACKUPIP  = LOCALHOST + "8001"
-	backupTime = 1 // Time interval for backing up the central manager metadata
-	healthCheckTime = 3 // Time interval for health check of the primary central manager
+	PAGE_NOT_FOUND = "page not found in any of the clients"
+	PAGE_LOST = "page was lost with the client that owned it"
+	PAGE_UPDATE = "PAGE_UPDATE"
+	HEARTBEAT = "HEARTBEAT"
+	NOT_MEMBER = "client is not a member of the network"
 )
 
+// Creates a central manager listening on ip, using cfg.Listen instead when it is set.
+// In fixed mode the address picks which partition of the pages this central manager manages,
+// and with replicas configured it picks which raft replica this central manager is.
+func NewCentralManager(ip string, cfg config.Config) *CentralManager {
+	if cfg.Listen != "" {
+		ip = cfg.Listen
+	}
+	cm := &CentralManager{
+		IP: ip,
+		PrimaryIP: cfg.Primary,
+		Backups: cfg.Standbys(),
+		Rank: -1,
+		BackupInterval: time.Duration(cfg.BackupInterval),
+		HealthCheckInterval: time.Duration(cfg.HealthCheckInterval),
+		LeaseDuration: time.Duration(cfg.LeaseDuration),
+		SuspicionThreshold: cfg.SuspicionThreshold,
+		leaseExpiry: time.Now().Add(time.Duration(cfg.LeaseDuration)), // The primary gets one lease to start renewing
+		Records: make(map[int]Record),
+		Members: make(map[int]string),
+		Lost: make(map[int]bool),
+		PageData: make(map[int][]byte),
+		LastSeen: make(map[int]time.Time),
+		silences: make(map[int]time.Time),
+		Pending: make(map[string]Request),
+		ReplicatePages: cfg.ReplicatePages,
+		ClientTimeout: time.Duration(cfg.ClientTimeout),
+		activeSince: time.Now(),
+		leaseSince: time.Now(),
+		Queues: make(map[int][]Request),
+		Transitions: make(map[int]Transition),
+		InvalidateTimeout: time.Duration(cfg.InvalidateTimeout),
+		invalidations: make(map[int]*invalidation),
+		synced: make(map[string]bool),
+		resynced: make(map[string]time.Time),
+		renewals: make(map[string]time.Time),
+		conns: make(map[net.Conn]bool),
+		transport: utils.TCP{},
+		pool: utils.DefaultPool,
+		DataDir: cfg.DataDir,
+		SnapshotInterval: time.Duration(cfg.SnapshotInterval),
+	}
+	for rank, managerIP := range cm.succession() {
+		if managerIP == ip && cm.Rank == -1 {
+			cm.Rank = rank
+		}
+	}
+	cm.IsBackup = cm.Rank > 0
+	cm.behind = cm.IsBackup // Until the active central manager has sent over its metadata
+	if cfg.Mode == config.FIXED {
+		cm.NumShards = len(cfg.Managers)
+		cm.Shard = -1
+		for shard, managerIP := range cfg.Managers {
+			if managerIP == ip {
+				cm.Shard = shard
+			}
+		}
+	}
+	for me, replicaIP := range cfg.Replicas {
+		if replicaIP == ip {
+			cm.raft = newRaftNode(cm, cfg.Replicas, me, time.Duration(cfg.ElectionTimeout), time.Duration(cfg.HeartbeatInterval), time.Duration(cfg.RequestTimeout))
+		}
+	}
+	return cm
+}
+
+// Whether this central manager is one of the raft replicas
+func (cm *CentralManager) IsReplica() bool {
+	return cm.raft != nil
+}
+
+// Moves the central manager onto another transport, e.g. utils.Memory to run it in the same process as the rest of the cluster.
+// Must be called before StartRPCServer.
+func (cm *CentralManager) UseTransport(transport utils.Transport) {
+	cm.transport = transport
+	cm.pool = utils.DefaultPool.WithTransport(transport)
+}
+
 // TODOS: Implement case when the primary central manager goes for rebooting
 // Workflow for the above: make a new variable called primary central down
 // This variable will be set to true when the primary central manager goes down
@@ -69,11 +205,64 @@ const (
 // If the primary is back alive, then the backup central manager will sync its metadata with the primary
 // Primary call Declare func to declare its the primary central manager
 
+ // RPCs that only the other central managers may make, checked when the nodes authenticate with certificates
+var managerOnly = map[string]bool{
+	"CentralManager.Backup": true,
+	"CentralManager.Replicate": true,
+	"CentralManager.RenewLease": true,
+	"CentralManager.DeclareCM": true,
+	"CentralManager.RequestVote": true,
+	"CentralManager.AppendEntries": true,
+}
+
+// Message types a client sends about itself, so its certificate has to be issued for the address in msg.IP
+var fromSender = map[string]bool{
+	READ: true,
+	WRITE: true,
+	HEARTBEAT: true,
+	READ_CONFIRMATION: true,
+	WRITE_CONFIRMATION: true,
+	INVALIDATE_CONFIRMATION: true,
+	PAGE_UPDATE: true,
+}
+
+// Checks that a client authenticated with a certificate only speaks for itself.
+// msg.IP has to be an address of its certificate, and msg.ID the client that joined from msg.IP.
+func (cm *CentralManager) guard(peer utils.Peer, method string, args interface{}) error {
+	msg, ok := args.(*message.Message)
+	if !ok || peer.Role == utils.MANAGER {
+		return nil
+	}
+	switch method {
+	case "CentralManager.ReceiveRequest":
+		if !fromSender[msg.Type] {
+			return nil
+		}
+	case "CentralManager.Join", "CentralManager.Leave":
+	default:
+		return nil
+	}
+	if !peer.Owns(msg.IP) {
+		return fmt.Errorf("the certificate of the client was not issued for %s", msg.IP)
+	}
+	if method == "CentralManager.Join" {
+		return nil // No id yet
+	}
+	cm.Lock.Lock()
+	defer cm.Lock.Unlock()
+	// Clients that are not members go through, they are told they are not members instead
+	if ip, ok := cm.Members[msg.ID]; ok && ip != msg.IP {
+		return fmt.Errorf("client %d is at %s, not %s", msg.ID, ip, msg.IP)
+	}
+	return nil
+}
+
  // Function to start the RPC server
- func (cm *CentralManager) StartRPCServer() {
-	rpc.Register(cm)
+func (cm *CentralManager) StartRPCServer() {
+	server := rpc.NewServer() // Own RPC server so that several central managers can live in one process
+	server.Register(cm)
 
-	listener, err := net.Listen("tcp", cm.IP)
+	listener, err := cm.transport.Listen(cm.IP)
 	if err != nil {
 		fmt.Printf("[CENTRAL-MANAGER] could not start listening: %s\n", err)
 		os.Exit(1)
@@ -84,210 +273,520 @@ const (
 
 	for {
 		conn, err := listener.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
 		if err != nil {
 			fmt.Printf("[CENTRAL-MANAGER] accept error: %s\n", err)
 			continue
 		}
 
-		if cm.IsRebooting {
+		if cm.rebooting() {
 			conn.Close()
 			time.Sleep(1 * time.Second)
 			continue
 		}
 
-		go rpc.ServeConn(conn)
+		cm.Lock.Lock()
+		cm.conns[conn] = true
+		cm.Lock.Unlock()
+		go func() {
+			utils.ServeConn(server, conn, managerOnly, cm.guard)
+			cm.Lock.Lock()
+			delete(cm.conns, conn)
+			cm.Lock.Unlock()
+		}()
 	}
 }
 
 func (cm *CentralManager) ReceiveRequest(msg message.Message, reply *message.Message) error {
-	cm.Lock.Lock()
-	val, ok := cm.Records[msg.PageID]
-	cm.Lock.Unlock()
+	if err := cm.checkEpoch(msg.Epoch); err != nil {
+		return err
+	}
+	if (msg.Type == READ || msg.Type == WRITE) && !cm.Manages(msg.PageID) {
+		return fmt.Errorf("page %d is not managed by this central manager", msg.PageID)
+	}
+
 	switch msg.Type {
 	case PING: 
 		// fmt.Printf("[CENTRAL-MANAGER] Received PING from client %d\n", msg.ID)
 		*reply = message.Message{
 			Type: ACK,
 		}
-	case READ:
-		// fmt.Printf("[CENTRAL-MANAGER] Received READ for page %d from client %d\n", msg.PageID, msg.ID)
-		if ok {
-			// Page found in one of the clients
-			// Forward the read request to the owner of the page
-			msg.Type = READ_FORWARD
-			val.Copies = append(val.Copies, Pointer{ID: msg.ID, IP: msg.IP})
-			cm.Lock.Lock()
-			cm.Records[msg.PageID] = val
-			cm.Lock.Unlock()
-			// fmt.Printf("[CENTRAL-MANAGER] Forwarding READ request for page %d to client %d. Copies: %v\n", msg.PageID, val.Owner.ID, val.Copies)
-			_, err := utils.CallByRPC(val.Owner.IP, "Client.ReceiveRequest", msg)
-			if err != nil {
-				return fmt.Errorf("error occurred while calling the client: %s", err)
-			}
-
-		} else {
+	case HEARTBEAT:
+		if !cm.isMember(msg.ID, msg.IP) {
+			// Evicted while it could not be reached, so its cache may be stale and it has to stop using it
+			return fmt.Errorf("%s: client %d at %s", NOT_MEMBER, msg.ID, msg.IP)
+		}
+		cm.heartbeat(msg.ID)
+		*reply = message.Message{Type: ACK}
+	case READ, WRITE:
+		// Every request for a page goes through the queue of that page so that operations on the same page are served in FIFO order
+		// while operations on different pages proceed in parallel.
+		// A WRITE for a page that does not exist yet creates it, a READ for it fails unless a WRITE is already queued
+		request := Request{Type: msg.Type, From: Pointer{ID: msg.ID, IP: msg.IP}, PageID: msg.PageID, ID: msg.RequestID}
+		res, err := cm.commit(Mutation{Op: ENQUEUE, PageID: msg.PageID, Request: request})
+		if err != nil {
+			return err
+		}
+		if res.Err != "" {
 			// Page not found in any of the clients
 			// fmt.Printf("[CENTRAL-MANAGER] Page %d not found in any of the clients\n", msg.PageID)
-			return fmt.Errorf("page not found in any of the clients")
-		}
-	case WRITE:
-		// Check if the page exists in records
-		// if so, then forward the request to the owner of the page
-		// invalidate the cache of the copies of this page
-		// if the page does not exist, then create a new record for this page
-		if cm.WriteQueue == nil {
-			cm.WriteQueue = []WriteRequest{}
-		}
-		// fmt.Printf("[CENTRAL-MANAGER] Received WRITE for page %d from client %d\n", msg.PageID, msg.ID)
-
-		if len(cm.WriteQueue) > 0 {
-			head := cm.WriteQueue[0]
-			if head.From.ID != msg.ID {
-				// if the current request is not from the head, then add to the queue
-				cm.WriteQueue = append(cm.WriteQueue, WriteRequest{From: Pointer{ID: msg.ID, IP: msg.IP}, PageID: msg.PageID})
-
-				// fmt.Printf("[CENTRAL-MANAGER] Added WRITE request to the queue. Queue: %v\n", cm.WriteQueue)
-				return nil
-			} else {
-				// if the current request is from the head, then do the write operation
-				go cm.WriteOP(msg)
+			return errors.New(res.Err)
+		}
+		if res.Duplicate {
+			// A retry of a request that is already queued or in flight, the client hears back from the original
+			fmt.Printf("[CENTRAL-MANAGER] Ignoring retried %s request %s for page %d from client %d\n", msg.Type, msg.RequestID, msg.PageID, msg.ID)
+			return nil
+		}
+		started := res.Started
+		// fmt.Printf("[CENTRAL-MANAGER] Added %s request to the queue of page %d. Queue: %v\n", msg.Type, msg.PageID, cm.Queues[msg.PageID])
+
+		for _, next := range started {
+			if next == request && next.Type == READ {
+				// Served right away so that errors make it back to the client
+				err := cm.ReadOP(msg)
+				if err != nil {
+					cm.complete(request)
+					return err
+				}
+				continue
 			}
-		} else {
-			// if the queue is empty, add the current write request to the queue
-			// and do the write operation
-			cm.WriteQueue = append(cm.WriteQueue, WriteRequest{From: Pointer{ID: msg.ID, IP: msg.IP}, PageID: msg.PageID})
-			// fmt.Printf("[CENTRAL-MANAGER] Added WRITE request to the queue. Queue: %v\n", cm.WriteQueue)
-			go cm.WriteOP(msg)
+			go cm.dispatch(next)
 		}
+
 	case READ_CONFIRMATION:
+		// The reader has its copy, so a queued WRITE may go ahead once every reader has confirmed
 		fmt.Printf("[CENTRAL-MANAGER] Received READ_CONFIRMATION for page %d from client %d\n", msg.PageID, msg.ID)
+		cm.complete(Request{Type: READ, From: Pointer{ID: msg.ID, IP: msg.IP}, PageID: msg.PageID, ID: msg.RequestID})
 
 	case WRITE_CONFIRMATION:
-		// Remove the head of the write queue
-		// Check if there are any more in the queue, then do a write operation for the next one
+		// The write transfer is over, so the record is up to date again
+		// Check if there are any more in the queue, then serve the next ones
 
 		fmt.Printf("[CENTRAL-MANAGER] Received WRITE_CONFIRMATION for page %d from client %d\n", msg.PageID, msg.ID)
-		if len(cm.WriteQueue) > 0 && cm.WriteQueue[0].From.ID == msg.ID {
-			cm.WriteQueue = cm.WriteQueue[1:] // Remove the first element from the queue
-		}
-
-		cm.Lock.Lock()
-		cm.Records[msg.PageID] = Record{ // Initialize the new owner of the page
+		_, err := cm.commit(Mutation{Op: SET_RECORD, PageID: msg.PageID, Record: Record{ // Initialize the new owner of the page
 			Copies: []Pointer{},
 			Owner: Pointer{ID: msg.ID, IP: msg.IP},
+		}})
+		if err != nil {
+			return err
 		}
-		cm.Lock.Unlock()
 
-		if len(cm.WriteQueue) > 0 {
-			// if there are more requests in the queue, then do the write operation for the next one
-			next := cm.WriteQueue[0]
-			go func() {
-				_, err := utils.CallByRPC(cm.IP, "CentralManager.ReceiveRequest", message.Message{Type: WRITE, ID: next.From.ID, IP: next.From.IP, PageID: next.PageID})
-				if err != nil {
-					fmt.Printf("error occurred while calling the client: %s", err)
-				}
-			}()
+		cm.complete(Request{Type: WRITE, From: Pointer{ID: msg.ID, IP: msg.IP}, PageID: msg.PageID, ID: msg.RequestID})
+
+	case PAGE_UPDATE: // Received in replica mode when the owner has written to the page
+		res, err := cm.commit(Mutation{Op: STORE_PAGE, PageID: msg.PageID, Pointer: Pointer{ID: msg.ID, IP: msg.IP}, Data: msg.Data})
+		if err != nil {
+			return err
+		}
+		if res.Err != "" {
+			return errors.New(res.Err)
 		}
 
 	case INVALIDATE_CONFIRMATION: // Received when the client has invalidated the cache
-		// Forward the write request to the owner of the page
+		// The write request is forwarded to the owner of the page once every copy has confirmed
 		fmt.Printf("[CENTRAL-MANAGER] Received INVALIDATE_CONFIRMATION for page %d from client %d\n", msg.PageID, msg.ID)
+		cm.confirmInvalidation(msg.PageID, msg.ID)
 	}
 
 	return nil
 }
 
+// Checks if the page belongs to the partition of this central manager
+func (cm *CentralManager) Manages(pageID int) bool {
+	return cm.NumShards == 0 || pageID%cm.NumShards == cm.Shard
+}
+
+// Function to perform read operation flow
+func (cm *CentralManager) ReadOP(msg message.Message) error {
+	res, err := cm.commit(Mutation{Op: ADD_COPY, PageID: msg.PageID, Pointer: Pointer{ID: msg.ID, IP: msg.IP}})
+	if err != nil {
+		return err
+	}
+	if res.Err != "" {
+		return errors.New(res.Err)
+	}
+	val := res.Record
+	reader := Pointer{ID: msg.ID, IP: msg.IP}
+	msg.Epoch = cm.CurrentEpoch()
+
+	for {
+		if val.Owner.ID == reader.ID {
+			// The page only survived in its replica, so the central manager hands it over itself
+			cm.Lock.Lock()
+			data := append([]byte(nil), cm.PageData[msg.PageID]...)
+			cm.Lock.Unlock()
+			_, err = cm.call(reader.IP, "Client.ReceiveRequest", message.Message{Type: RECEIVE_PAGE, PageID: msg.PageID, Permission: READ, Data: data, RequestID: msg.RequestID, Epoch: msg.Epoch})
+			if err != nil {
+				return fmt.Errorf("error occurred while calling the client: %s", err)
+			}
+			return nil
+		}
+
+		// Page found in one of the clients
+		// Forward the read request to the owner of the page
+		forward := msg
+		forward.Type = READ_FORWARD
+		// fmt.Printf("[CENTRAL-MANAGER] Forwarding READ request for page %d to client %d. Copies: %v\n", msg.PageID, val.Owner.ID, val.Copies)
+		_, err = cm.callClient(val.Owner, forward)
+		if !utils.IsUnreachable(err) {
+			if err != nil {
+				return fmt.Errorf("error occurred while calling the client: %s", err)
+			}
+			return nil
+		}
+
+		// The owner is gone, hand its pages to the survivors and retry with the new owner
+		fmt.Printf("[CENTRAL-MANAGER] Client %d owning page %d is dead, evicting it: %s\n", val.Owner.ID, msg.PageID, err)
+		res, err = cm.evictClient(val.Owner, msg)
+		if err != nil {
+			return err
+		}
+		if res.Err != "" {
+			return errors.New(res.Err)
+		}
+		val = res.Record
+	}
+}
+
+// Starts the requests at the head of the page queue that may run given the state of the page, must be called with the lock held.
+// Any number of READs may be in flight together, but a WRITE has to wait for every READ_CONFIRMATION
+// and nothing else starts until its WRITE_CONFIRMATION arrives, since the owner in the record is stale during the transfer.
+func (cm *CentralManager) advance(pageID int) []Request {
+	var started []Request
+	transition := cm.Transitions[pageID]
+	queue := cm.Queues[pageID]
+	for len(queue) > 0 && !transition.Writing {
+		head := queue[0]
+		if head.Type == WRITE {
+			if transition.Readers > 0 {
+				break
+			}
+			transition.Writing = true
+		} else {
+			transition.Readers++
+		}
+		started = append(started, head)
+		queue = queue[1:] // Remove the first element from the queue
+	}
+
+	if len(queue) == 0 {
+		delete(cm.Queues, pageID)
+	} else {
+		cm.Queues[pageID] = queue
+	}
+	if transition == (Transition{}) {
+		delete(cm.Transitions, pageID)
+	} else {
+		cm.Transitions[pageID] = transition
+	}
+	return started
+}
+
+// Marks the request as no longer in flight and serves the next requests for its page
+func (cm *CentralManager) complete(done Request) {
+	res, err := cm.commit(Mutation{Op: COMPLETE, PageID: done.PageID, Request: done})
+	if err != nil {
+		fmt.Printf("[CENTRAL-MANAGER] Error occurred while completing %s for page %d: %s\n", done.Type, done.PageID, err)
+		return
+	}
+
+	for _, next := range res.Started {
+		go cm.dispatch(next)
+	}
+}
+
+// Serves a request that was started from its page queue
+func (cm *CentralManager) dispatch(request Request) {
+	msg := message.Message{Type: request.Type, ID: request.From.ID, IP: request.From.IP, PageID: request.PageID, RequestID: request.ID}
+	if request.Type == WRITE {
+		cm.WriteOP(msg)
+		return
+	}
+	err := cm.ReadOP(msg)
+	if err != nil {
+		// The reader will not confirm, so move on to the next request
+		fmt.Printf("[CENTRAL-MANAGER] Error occurred while serving READ for page %d from client %d: %s\n", request.PageID, request.From.ID, err)
+		if err.Error() == PAGE_LOST {
+			cm.notifyLost(msg)
+		}
+		cm.complete(request)
+	}
+}
+
+// Removes a client found dead while serving msg, handing the pages it owned to the survivors.
+// Returns once the client has stopped using its cache, which it does after going ClientTimeout without a heartbeat getting through.
+func (cm *CentralManager) evictClient(dead Pointer, msg message.Message) (result, error) {
+	silent := cm.silentBy(dead.ID)
+	request := Request{Type: msg.Type, From: Pointer{ID: msg.ID, IP: msg.IP}, PageID: msg.PageID, ID: msg.RequestID}
+	res, err := cm.commit(Mutation{Op: EVICT, PageID: msg.PageID, Pointer: dead, Request: request})
+	if err != nil {
+		return res, err
+	}
+	cm.forget(dead.ID)
+	if wait := time.Until(silent); wait > 0 {
+		fmt.Printf("[CENTRAL-MANAGER] Waiting %s for client %d to stop using its cache\n", wait.Round(time.Millisecond), dead.ID)
+		time.Sleep(wait)
+	}
+	for _, next := range res.Started {
+		go cm.dispatch(next) // Took the place of the requests the dead client will never confirm
+	}
+	return res, nil
+}
+
+// Tells the client that the page it asked for was lost, so that its fault fails right away instead of timing out
+func (cm *CentralManager) notifyLost(msg message.Message) {
+	_, err := cm.call(msg.IP, "Client.ReceiveRequest", message.Message{Type: PAGE_LOST, PageID: msg.PageID, Epoch: cm.CurrentEpoch()})
+	if err != nil {
+		fmt.Printf("[CENTRAL-MANAGER] Error occurred while telling client %d that page %d was lost: %s\n", msg.ID, msg.PageID, err)
+	}
+}
+
+// Checks if a request of the given type is queued for the page, must be called with the lock held
+func (cm *CentralManager) hasQueued(pageID int, requestType string) bool {
+	for _, request := range cm.Queues[pageID] {
+		if request.Type == requestType {
+			return true
+		}
+	}
+	return false
+}
+
 // Function to perform write operation flow
 func (cm *CentralManager) WriteOP(msg message.Message){
 	cm.Lock.Lock()
 	val, ok := cm.Records[msg.PageID]
+	msg.Epoch = cm.Epoch
 	cm.Lock.Unlock()
 	if ok {
 		// Page found in one of the clients
 		// Invalidate the cache of the copies of this page and make the prev owner send the current copy with write perms to new owner
+		// The page is only handed over once every copy is gone, otherwise a reader could still see the old contents
+		done := cm.expectInvalidations(msg.PageID, val.Copies)
 		for _, copy := range val.Copies {
-			msg.Type = INVALIDATE_CACHE
-			// fmt.Printf("[CENTRAL-MANAGER] Forwarding INVALIDATE_CACHE request to client %d\n", copy.ID)
-			_, err := utils.CallByRPC(copy.IP, "Client.ReceiveRequest", msg)
-			if err != nil {
-				fmt.Printf("error occurred while INVALIDATE_CACHE: %s", err)
+			invalidate := msg
+			invalidate.Type = INVALIDATE_CACHE
+			go func() {
+				// fmt.Printf("[CENTRAL-MANAGER] Forwarding INVALIDATE_CACHE request to client %d\n", copy.ID)
+				_, err := cm.callClient(copy, invalidate)
+				if err != nil {
+					// The copyholder may still hold the page, so it is evicted instead of waiting for it
+					fmt.Printf("[CENTRAL-MANAGER] Error occurred while INVALIDATE_CACHE for page %d at client %d, evicting it: %s\n", msg.PageID, copy.ID, err)
+					if _, err := cm.evictClient(copy, msg); err != nil {
+						fmt.Printf("[CENTRAL-MANAGER] Error occurred while evicting client %d: %s\n", copy.ID, err)
+						return // Left pending, the timeout below tries again
+					}
+					cm.confirmInvalidation(msg.PageID, copy.ID)
+				}
+			}()
+		}
+
+		select {
+		case <-done:
+		case <-time.After(cm.InvalidateTimeout):
+			failed := cm.dropInvalidations(msg.PageID)
+			fmt.Printf("[CENTRAL-MANAGER] Timed out waiting for INVALIDATE_CONFIRMATION for page %d, evicting clients %v\n", msg.PageID, failed)
+			// Their copies may still be readable, so they are out of the membership before the page changes hands
+			for _, copy := range val.Copies {
+				if !slices.Contains(failed, copy.ID) {
+					continue
+				}
+				if _, err := cm.evictClient(copy, msg); err != nil {
+					fmt.Printf("[CENTRAL-MANAGER] Error occurred while evicting client %d: %s\n", copy.ID, err)
+					cm.complete(Request{Type: WRITE, From: Pointer{ID: msg.ID, IP: msg.IP}, PageID: msg.PageID, ID: msg.RequestID})
+					return
+				}
 			}
 		}
 
 		// Forward the write request to the owner of the page
-		msg.Type = WRITE_FORWARD
-		_, err := utils.CallByRPC(val.Owner.IP, "Client.ReceiveRequest", msg)
-		if err != nil {
-			fmt.Printf("error occurred while calling the client: %s", err)	
+		forward := msg
+		forward.Type = WRITE_FORWARD
+		_, err := cm.callClient(val.Owner, forward)
+		if !utils.IsUnreachable(err) {
+			if err != nil {
+				// The owner kept the page or could not hand it over, either way the writer will not confirm
+				fmt.Printf("[CENTRAL-MANAGER] Error occurred while forwarding WRITE for page %d to client %d: %s\n", msg.PageID, val.Owner.ID, err)
+				cm.complete(Request{Type: WRITE, From: Pointer{ID: msg.ID, IP: msg.IP}, PageID: msg.PageID, ID: msg.RequestID})
+			}
+			return
 		}
 
+		// The copies are already invalidated, so the page only survives the owner if it has a replica
+		fmt.Printf("[CENTRAL-MANAGER] Client %d owning page %d is dead, evicting it: %s\n", val.Owner.ID, msg.PageID, err)
+		res, err := cm.evictClient(val.Owner, msg)
+		if err != nil || res.Err != "" {
+			// The writer will not confirm, so move on to the next request
+			if err != nil {
+				fmt.Printf("[CENTRAL-MANAGER] Error occurred while evicting client %d: %s\n", val.Owner.ID, err)
+			} else {
+				cm.notifyLost(msg)
+			}
+			cm.complete(Request{Type: WRITE, From: Pointer{ID: msg.ID, IP: msg.IP}, PageID: msg.PageID, ID: msg.RequestID})
+			return
+		}
+		cm.WriteOP(msg) // Served from the replica
 	} else {
 		// Page not found in any of the records
 		// Create a new record for this page
 		// Make the owner of the page the one who is writing
+		// If the page only survived in its replica, the writer starts from the replicated contents
+		cm.Lock.Lock()
+		data := append([]byte(nil), cm.PageData[msg.PageID]...)
+		cm.Lock.Unlock()
 
+		// The record goes first, so the writer never holds a page the metadata does not know about
+		// and the copies added once the writer has confirmed are not overwritten by it
+		_, err := cm.commit(Mutation{Op: SET_RECORD, PageID: msg.PageID, Record: Record{
+			Copies: []Pointer{},
+			Owner: Pointer{ID: msg.ID, IP: msg.IP},
+		}})
+		if err != nil {
+			fmt.Printf("[CENTRAL-MANAGER] Error occurred while creating the record for page %d: %s\n", msg.PageID, err)
+			cm.complete(Request{Type: WRITE, From: Pointer{ID: msg.ID, IP: msg.IP}, PageID: msg.PageID, ID: msg.RequestID})
+			return
+		}
 		go func() {
-			_, err := utils.CallByRPC(msg.IP, "Client.ReceiveRequest", message.Message{Type: RECEIVE_PAGE, PageID: msg.PageID, Permission: WRITE})
+			_, err := cm.call(msg.IP, "Client.ReceiveRequest", message.Message{Type: RECEIVE_PAGE, PageID: msg.PageID, Permission: WRITE, Data: data, RequestID: msg.RequestID, Epoch: msg.Epoch})
 			if err != nil {
-				fmt.Printf("error occurred while calling the client: %s", err)
+				// The writer will not confirm, so move on to the next request
+				fmt.Printf("[CENTRAL-MANAGER] Error occurred while sending page %d to client %d: %s\n", msg.PageID, msg.ID, err)
+				cm.complete(Request{Type: WRITE, From: Pointer{ID: msg.ID, IP: msg.IP}, PageID: msg.PageID, ID: msg.RequestID})
 			}
 		}()
-		cm.Lock.Lock()
-		cm.Records[msg.PageID] = Record{
-			Copies: []Pointer{},
-			Owner: Pointer{ID: msg.ID, IP: msg.IP},
-		}
-		cm.Lock.Unlock()
 	}
 }
 
-// Function to check the health of the primary central manager
+// Starts collecting the INVALIDATE_CONFIRMATIONs of the copies of a page, the returned channel is closed once all of them arrived
+func (cm *CentralManager) expectInvalidations(pageID int, copies []Pointer) chan struct{} {
+	inv := &invalidation{pending: make(map[int]bool), done: make(chan struct{})}
+	for _, copy := range copies {
+		inv.pending[copy.ID] = true
+	}
+	if len(inv.pending) == 0 {
+		close(inv.done)
+		return inv.done
+	}
+	cm.Lock.Lock()
+	cm.invalidations[pageID] = inv
+	cm.Lock.Unlock()
+	return inv.done
+}
+
+// Marks the copy held by the client as invalidated
+func (cm *CentralManager) confirmInvalidation(pageID int, clientID int) {
+	cm.Lock.Lock()
+	defer cm.Lock.Unlock()
+	inv, ok := cm.invalidations[pageID]
+	if !ok || !inv.pending[clientID] {
+		return
+	}
+	delete(inv.pending, clientID)
+	if len(inv.pending) == 0 {
+		delete(cm.invalidations, pageID)
+		close(inv.done)
+	}
+}
+
+// Stops waiting for the invalidations of a page and returns the clients that never confirmed
+func (cm *CentralManager) dropInvalidations(pageID int) []int {
+	cm.Lock.Lock()
+	defer cm.Lock.Unlock()
+	inv, ok := cm.invalidations[pageID]
+	if !ok {
+		return nil
+	}
+	delete(cm.invalidations, pageID)
+	var failed []int
+	for clientID := range inv.pending {
+		failed = append(failed, clientID)
+	}
+	return failed
+}
+
+// Function to check the health of the central managers ahead of this backup.
+// The active central manager holds a lease that it keeps renewing with the backups, and a backup only takes over once the lease
+// has been found expired on SuspicionThreshold health checks in a row, so a single lost renewal does not cause a failover.
+// It also has to find every backup ahead of it down, since the first one still alive is the one to take over.
 func (cm *CentralManager) HealthCheck() {
+	misses := 0
+	waiting := false // Whether the lease has expired while this central manager was behind
 	for {
-		// Make a ping RPC call to the primary central manager
-		_, err := utils.CallByRPC(CENTRALIP, "CentralManager.Ping", message.Message{Type: PING})
-		if err != nil && !cm.isDead {
-			fmt.Printf("[CENTRAL-MANAGER] The primary central manager is down. Starting the backup central manager...\n")
-			cm.isDead = true
-			var reply message.Message
-			cm.DeclareCM(message.Message{}, &reply) // Function to declare the backup central manager as the primary central manager
-		} else if err == nil && cm.isDead {
+		if cm.rebooting() {
+			misses = 0 // Neither takes over nor hands back while down
+		} else if !cm.tookOver() {
+			if cm.leaseExpired() && !cm.aheadAlive() {
+				if cm.caughtUp() {
+					misses++
+				} else if !waiting {
+					fmt.Printf("[CENTRAL-MANAGER] The lease has expired but this central manager may be missing mutations, it cannot take over until it is synced\n")
+					waiting = true
+				}
+			} else {
+				misses = 0
+				waiting = false
+			}
+			if misses >= cm.SuspicionThreshold {
+				fmt.Printf("[CENTRAL-MANAGER] The lease has expired for %d health checks and no central manager ahead is alive. Starting the backup central manager...\n", misses)
+				cm.Lock.Lock()
+				cm.isDead = true
+				cm.Lock.Unlock()
+				misses = 0
+				var reply message.Message
+				cm.DeclareCM(message.Message{}, &reply) // Function to declare the backup central manager as the primary central manager
+			}
+		} else if _, err := cm.call(cm.PrimaryIP, "CentralManager.Ping", message.Message{Type: PING}); err == nil {
 			fmt.Printf("[CENTRAL-MANAGER] The primary central manager is back alive. Syncing the metadata with the primary central manager...\n")
+			// Standing by again before taking the metadata to sync, so no commit can change it afterwards
+			cm.shipLock.Lock()
+			cm.Lock.Lock()
 			cm.isDead = false
+			cm.Lock.Unlock()
+			metadata := cm.syncMessage()
+			cm.shipLock.Unlock()
+			cm.extendLease(cm.LeaseDuration) // Give the primary time to start renewing again
 			// Sync the metadata with the primary central manager
-			msg := SyncMessage{
-				Records: cm.Records,
-				WriteQueue: cm.WriteQueue,
-			}
-			client, err := rpc.Dial("tcp", CENTRALIP)
-			if err != nil {
-				fmt.Printf("[CENTRAL-MANAGER] Error in dialing: %s", err)
-			}
-		
 			var reply SyncMessage
-			err = client.Call("CentralManager.Backup", msg, &reply)
+			err := cm.callManager(cm.PrimaryIP, "CentralManager.Backup", metadata, &reply)
 			if err != nil {
-				fmt.Printf("[CENTRAL-MANAGER] Error in calling %s: %s", "CentralManager.Backup", err)
+				fmt.Printf("[CENTRAL-MANAGER] Error occurred while syncing the primary central manager: %s\n", err)
 			}
-			client.Close()
 
 			// Call declare function in the central manager node
-			_, err = utils.CallByRPC(CENTRALIP, "CentralManager.DeclareCM", message.Message{})
+			_, err = cm.call(cm.PrimaryIP, "CentralManager.DeclareCM", message.Message{})
 			if err != nil {
 				fmt.Printf("[CENTRAL-MANAGER] Error occurred while declaring the primary central manager: %s\n", err)
 			}
 		}
-		time.Sleep(healthCheckTime * time.Second)
+		time.Sleep(cm.HealthCheckInterval)
 	}
 }
 
 // Function to declare as primary central manager, applies to primary and backup central managers
+// Taking over starts a new epoch, with raft replication the epoch is the term set when the leader was elected.
 func (cm *CentralManager) DeclareCM(msg message.Message, reply *message.Message) error {
-	fmt.Printf("[CENTRAL-MANAGER] Declaring this central manager as the primary central manager\n")
-	nodesList := utils.ReadNodesList()	
-	for _, ip := range nodesList {
+	cm.Lock.Lock()
+	if cm.raft == nil {
+		cm.Epoch = cm.nextEpoch()
+	}
+	cm.fenced = false
+	cm.activeSince = time.Now()
+	cm.leaseSince = cm.activeSince
+	epoch := cm.Epoch
+	members := cm.Clients()
+	raft := cm.raft != nil
+	cm.Lock.Unlock()
+	fmt.Printf("[CENTRAL-MANAGER] Declaring this central manager as the primary central manager in epoch %d\n", epoch)
+	if !raft {
+		// The requests in flight died with the old primary, the clients retry them once they hear about this one
+		if _, err := cm.commit(Mutation{Op: TAKEOVER}); err != nil {
+			return err
+		}
+	}
+	for _, ip := range members {
 		go func() {
-			_, err := utils.CallByRPC(ip, "Client.UpdateServerIP", message.Message{IP: cm.IP})
+			_, err := cm.call(ip, "Client.UpdateServerIP", message.Message{IP: cm.IP, Epoch: epoch})
 			if err != nil {
 				fmt.Printf("[CENTRAL-MANAGER] Error occurred while updating the server IP: %s\n", err)
 			}
@@ -296,36 +795,171 @@ func (cm *CentralManager) DeclareCM(msg message.Message, reply *message.Message)
 	return nil
 }
 
+// Function to keep the other central managers in the succession in sync while this one is active.
+// Every mutation is shipped to them as it is committed, this loop only sends over the whole metadata
+// to the ones that have fallen behind, e.g. because they were down or have just started.
 func (cm *CentralManager) StartBackup() {
 	for {
-		// Make an RPC call here to the backup central manager
-		msg := SyncMessage{
-			Records: cm.Records,
-			WriteQueue: cm.WriteQueue,
-		}
-		client, err := rpc.Dial("tcp", BACKUPIP)
-		if err != nil {
-			fmt.Printf("[CENTRAL-MANAGER] Error in dialing: %s", err)
-		}
-	
-		var reply SyncMessage
-		err = client.Call("CentralManager.Backup", msg, &reply)
-		if err != nil {
-			// fmt.Printf("[CENTRAL-MANAGER] Error in calling %s: %s", "CentralManager.Backup", err)
+		cm.shipLock.Lock()
+		for _, ip := range cm.others() {
+			if cm.synced[ip] || !cm.active() || cm.rebooting() { // The metadata is not all there while rebooting
+				continue
+			}
+			err := cm.resync(ip)
+			if err == nil {
+				fmt.Printf("[CENTRAL-MANAGER] Central manager %s is in sync\n", ip)
+				cm.synced[ip] = true
+			} else if isStaleEpoch(err) {
+				cm.stepDown(err)
+			}
 		}
-		client.Close()
+		cm.shipLock.Unlock()
 
-		time.Sleep(backupTime * time.Second)
+		time.Sleep(cm.BackupInterval)
 	}
 }
 
 func (cm *CentralManager) Backup(msg SyncMessage, reply *SyncMessage) error {
 	// fmt.Printf("[CENTRAL-MANAGER] Received backup message from primary central manager\n")
+	msg.init()
+	cm.Lock.Lock()
+	if msg.Epoch < cm.Epoch {
+		defer cm.Lock.Unlock()
+		return staleEpoch(msg.Epoch, cm.Epoch) // Sent by a primary that has been replaced
+	}
+	cm.Epoch = msg.Epoch
+	cm.fenced = false // Caught up with the active central manager, so it may serve again
 	cm.Records = msg.Records
-	cm.WriteQueue = msg.WriteQueue
+	cm.Queues = msg.Queues
+	cm.Transitions = msg.Transitions
+	cm.Members = msg.Members
+	cm.Lost = msg.Lost
+	cm.PageData = msg.PageData
+	cm.LastSeen = msg.LastSeen
+	cm.Pending = msg.Pending
+	cm.NextID = msg.NextID
+	cm.Seq = msg.Seq
+	cm.shipped = msg.Seq
+	cm.behind = false
+	err := cm.store.snapshot(msg) // The metadata was replaced wholesale, so the old log no longer applies
+	cm.Lock.Unlock()
+	return err
+}
+
+// Builds the metadata sent over to the other central manager
+func (cm *CentralManager) syncMessage() SyncMessage {
+	cm.Lock.Lock()
+	defer cm.Lock.Unlock()
+	return cm.syncMessageLocked()
+}
+
+// Builds the metadata sent over to the other central manager, must be called with the lock held
+func (cm *CentralManager) syncMessageLocked() SyncMessage {
+	// Copies are sent since the maps keep changing while the message is being encoded
+	records := make(map[int]Record, len(cm.Records))
+	for pageID, record := range cm.Records {
+		records[pageID] = Record{Copies: append([]Pointer{}, record.Copies...), Owner: record.Owner}
+	}
+	queues := make(map[int][]Request, len(cm.Queues))
+	for pageID, queue := range cm.Queues {
+		queues[pageID] = append([]Request{}, queue...)
+	}
+	transitions := make(map[int]Transition, len(cm.Transitions))
+	for pageID, transition := range cm.Transitions {
+		transitions[pageID] = transition
+	}
+	lost := make(map[int]bool, len(cm.Lost))
+	for pageID := range cm.Lost {
+		lost[pageID] = true
+	}
+	pageData := make(map[int][]byte, len(cm.PageData))
+	for pageID, data := range cm.PageData {
+		pageData[pageID] = data // Replicas are replaced, never modified in place
+	}
+	pending := make(map[string]Request, len(cm.Pending))
+	for id, request := range cm.Pending {
+		pending[id] = request
+	}
+	return SyncMessage{
+		Records: records,
+		Queues: queues,
+		Transitions: transitions,
+		Members: cm.Clients(),
+		Lost: lost,
+		PageData: pageData,
+		LastSeen: cm.liveness(),
+		Pending: pending,
+		NextID: cm.NextID,
+		Seq: cm.Seq,
+		Epoch: cm.Epoch,
+	}
+}
+
+// Function for a client to join the network, replies with the client id assigned to it
+func (cm *CentralManager) Join(msg message.Message, reply *message.Message) error {
+	if err := cm.checkEpoch(msg.Epoch); err != nil {
+		return err
+	}
+	res, err := cm.commit(Mutation{Op: JOIN, Pointer: Pointer{IP: msg.IP}})
+	if err != nil {
+		return err
+	}
+	cm.heartbeat(res.ClientID) // Counts as the first heartbeat
+	fmt.Printf("[CENTRAL-MANAGER] Client %d joined from %s\n", res.ClientID, msg.IP)
+	*reply = message.Message{Type: ACK, ID: res.ClientID, Epoch: cm.CurrentEpoch()}
+	return nil
+}
+
+// Function for a client to leave the network.
+// The pages it owns go to a copyholder, or to the central manager with the contents in msg.Contents,
+// and it is only told to go once no record names it anymore.
+func (cm *CentralManager) Leave(msg message.Message, reply *message.Message) error {
+	if err := cm.checkEpoch(msg.Epoch); err != nil {
+		return err
+	}
+	res, err := cm.commit(Mutation{Op: LEAVE, Pointer: Pointer{ID: msg.ID, IP: msg.IP}, Contents: msg.Contents})
+	if err != nil {
+		return err
+	}
+	for _, next := range res.Started {
+		go cm.dispatch(next)
+	}
+	if pages := cm.holdings(msg.ID); len(pages) > 0 {
+		return fmt.Errorf("client %d is still recorded for pages %v", msg.ID, pages)
+	}
+	cm.forget(msg.ID)
+	fmt.Printf("[CENTRAL-MANAGER] Client %d left the network\n", msg.ID)
+	*reply = message.Message{Type: ACK}
 	return nil
 }
 
+// Returns the pages whose record names the client as owner or copyholder
+func (cm *CentralManager) holdings(clientID int) []int {
+	cm.Lock.Lock()
+	defer cm.Lock.Unlock()
+	var pages []int
+	for pageID, record := range cm.Records {
+		holds := record.Owner.ID == clientID
+		for _, copy := range record.Copies {
+			holds = holds || copy.ID == clientID
+		}
+		if holds {
+			pages = append(pages, pageID)
+		}
+	}
+	sort.Ints(pages)
+	return pages
+}
+
+// Returns a copy of the membership table, must be called with the lock held
+func (cm *CentralManager) Clients() map[int]string {
+	members := make(map[int]string, len(cm.Members))
+	for id, ip := range cm.Members {
+		members[id] = ip
+	}
+	return members
+}
+
 func (cm *CentralManager) Ping(msg message.Message, reply *message.Message) error {
 	return nil
 }
@@ -337,29 +971,21 @@ func (cm *CentralManager) CalculateAverageResponseTime(msg message.Message, repl
 	// Check if all the responses for the avg time have been received
 	// If so, then calculate the average response time
 	cm.Lock.Lock()
-	TotalReadTime += msg.AvgReadPerNode
-	TotalWriteTime += msg.AvgWritePerNode
-	if _, ok := count[REQ]; !ok {
-		count[REQ] = 0
-	}
-	count[REQ]++
+	cm.totalReadTime += msg.AvgReadPerNode
+	cm.totalWriteTime += msg.AvgWritePerNode
+	cm.reports++
 	if msg.AvgReadPerNode != 0 {
-		if _, ok := count[READ]; !ok {
-			count[READ] = 0
-		}
-		count[READ]++
+		cm.readReports++
 	}
 	if msg.AvgWritePerNode != 0 {
-		if _, ok := count[WRITE]; !ok {
-			count[WRITE] = 0
-		}
-		count[WRITE]++
+		cm.writeReports++
 	}
+	allReported := cm.reports == len(cm.Members) // Every client that joined has sent its averages
+	avgReadTime := cm.totalReadTime / float64(cm.readReports)
+	avgWriteTime := cm.totalWriteTime / float64(cm.writeReports)
 	cm.Lock.Unlock()
 
-	if count[REQ] == 10 {
-		avgReadTime := TotalReadTime / float64(count[READ])
-		avgWriteTime := TotalWriteTime / float64(count[WRITE])
+	if allReported {
 		fmt.Printf(green + "[CENTRAL-MANAGER] Average read time: %f ms\n" + reset, avgReadTime * 1000)
 		fmt.Printf(green + "[CENTRAL-MANAGER] Average write time: %f ms\n" + reset, avgWriteTime * 1000)
 	}
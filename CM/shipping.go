@@ -0,0 +1,119 @@
+package CM
+
+import (
+	"context"
+	"fmt"
+	"ivy/message"
+	"ivy/utils"
+	"sync"
+	"time"
+)
+
+// Sends a committed mutation to every synced central manager in the succession and waits for their acks.
+// A central manager that cannot take it is sent the whole metadata instead, and the commit waits until that
+// gets through, since a standby cut off from the active central manager may take over without the mutation.
+// Only a central manager that is down is left behind, it has to be resynced by StartBackup before it may take over.
+// Fails when one of them has taken over with a newer epoch, in which case this central manager steps down,
+// or when this central manager no longer holds the lease, in which case a standby may take over without the mutation.
+// Must be called with shipLock held so that the standbys see the mutations in commit order.
+func (cm *CentralManager) ship(msg ShipMessage) error {
+	var wg sync.WaitGroup
+	errs := make(map[string]error)
+	var lock sync.Mutex
+	for ip, synced := range cm.synced {
+		if !synced {
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := cm.shipTo(ip, msg)
+			lock.Lock()
+			errs[ip] = err
+			lock.Unlock()
+		}()
+	}
+	wg.Wait()
+
+	for ip, err := range errs {
+		for err != nil && !isStaleEpoch(err) && !utils.IsDown(err) {
+			cm.Lock.Lock()
+			lease := cm.holdsLease() && !cm.fenced
+			cm.Lock.Unlock()
+			if !lease {
+				return fmt.Errorf("%s: could not ship mutation %d to central manager %s before the lease ran out: %s", STALE_EPOCH, msg.Seq, ip, err)
+			}
+			fmt.Printf("[CENTRAL-MANAGER] Could not ship mutation %d to central manager %s, retrying: %s\n", msg.Seq, ip, err)
+			time.Sleep(cm.LeaseDuration / 3)
+			err = cm.resync(ip)
+		}
+		if isStaleEpoch(err) {
+			return cm.stepDown(err)
+		}
+		if err != nil {
+			fmt.Printf("[CENTRAL-MANAGER] Central manager %s is down, it is behind until it can be resynced: %s\n", ip, err)
+			cm.synced[ip] = false
+		}
+	}
+	return nil
+}
+
+// Ships the mutation to one central manager, falling back to sending it the whole metadata
+func (cm *CentralManager) shipTo(ip string, msg ShipMessage) error {
+	var reply ShipMessage
+	err := cm.callManager(ip, "CentralManager.Replicate", msg, &reply)
+	if err == nil || isStaleEpoch(err) {
+		return err
+	}
+	fmt.Printf("[CENTRAL-MANAGER] Could not ship %s to central manager %s, resyncing: %s\n", msg.Mutation.Op, ip, err)
+	return cm.resync(ip)
+}
+
+// Sends the whole metadata to another central manager, must be called with shipLock held
+func (cm *CentralManager) resync(ip string) error {
+	var reply SyncMessage
+	err := cm.callManager(ip, "CentralManager.Backup", cm.syncMessage(), &reply)
+	if err == nil {
+		cm.resynced[ip] = time.Now()
+	}
+	return err
+}
+
+// Sends msg to the method on another node over the transport of this central manager,
+// with the deadline configured for the type of msg
+func (cm *CentralManager) call(ip string, method string, msg message.Message) (message.Message, error) {
+	return cm.pool.Send(context.Background(), ip, method, msg)
+}
+
+// Makes an RPC call to the other central manager over the pooled connection, with the deadline configured for the method
+func (cm *CentralManager) callManager(ip string, method string, args interface{}, reply interface{}) error {
+	ctx, cancel := cm.pool.WithTimeout(context.Background(), method)
+	defer cancel()
+	err := cm.pool.Call(ctx, ip, method, args, reply)
+	if err != nil {
+		return fmt.Errorf("error in calling %s: %s", method, err)
+	}
+	return nil
+}
+
+// RPC called by the active central manager with every mutation it commits
+// The mutations are applied strictly in sequence, a standby that missed one is behind until it is sent the whole metadata.
+func (cm *CentralManager) Replicate(msg ShipMessage, reply *ShipMessage) error {
+	cm.Lock.Lock()
+	defer cm.Lock.Unlock()
+	if err := cm.acceptActive(msg.Epoch); err != nil {
+		return err
+	}
+	if msg.Seq != cm.Seq+1 {
+		cm.behind = true
+		return fmt.Errorf("out of sequence mutation %d, expected %d", msg.Seq, cm.Seq+1)
+	}
+	if err := cm.store.append(msg); err != nil {
+		return err
+	}
+	cm.apply(msg.Mutation)
+	cm.Seq = msg.Seq
+	cm.behind = false // The active central manager only ships to the standbys it has synced
+	*reply = ShipMessage{Seq: cm.Seq}
+	return nil
+}
@@ -0,0 +1,223 @@
+package CM
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// On-disk copy of the central manager metadata.
+// Every mutation is appended to a write-ahead log before it is applied, and a snapshot of the whole
+// metadata periodically replaces the log, so a restarted central manager can rebuild its state on its own.
+type store struct {
+	dir string
+	wal *os.File
+}
+
+const (
+	SNAPSHOT_FILE = "snapshot.json"
+	WAL_FILE      = "wal.jsonl"
+)
+
+// Opens the store in dir, returning the last snapshot and the log entries written after it
+func openStore(dir string) (*store, SyncMessage, []ShipMessage, error) {
+	var snapshot SyncMessage
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, snapshot, nil, fmt.Errorf("error creating data directory %s: %s", dir, err)
+	}
+
+	data, err := os.ReadFile(filepath.Join(dir, SNAPSHOT_FILE))
+	if err == nil {
+		err = json.Unmarshal(data, &snapshot)
+	}
+	if err != nil && !os.IsNotExist(err) {
+		return nil, snapshot, nil, fmt.Errorf("error reading snapshot in %s: %s", dir, err)
+	}
+	snapshot.init()
+
+	wal, err := os.OpenFile(filepath.Join(dir, WAL_FILE), os.O_CREATE|os.O_RDWR|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, snapshot, nil, fmt.Errorf("error opening write-ahead log in %s: %s", dir, err)
+	}
+	var entries []ShipMessage
+	scanner := bufio.NewScanner(wal)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		var entry ShipMessage
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			break // A torn write from a crash, everything before it is intact
+		}
+		entries = append(entries, entry)
+	}
+	return &store{dir: dir, wal: wal}, snapshot, entries, nil
+}
+
+// Appends the mutation to the write-ahead log and flushes it to disk
+func (s *store) append(entry ShipMessage) error {
+	if s == nil {
+		return nil
+	}
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	if _, err := s.wal.Write(append(data, '\n')); err != nil {
+		return fmt.Errorf("error writing to the write-ahead log: %s", err)
+	}
+	return s.wal.Sync()
+}
+
+// Replaces the snapshot and empties the write-ahead log, whose entries are all part of the new snapshot
+func (s *store) snapshot(msg SyncMessage) error {
+	if s == nil {
+		return nil
+	}
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	// The snapshot has to be on disk before the log goes, or a crash in between would lose both
+	if err := writeFile(filepath.Join(s.dir, SNAPSHOT_FILE), data); err != nil {
+		return fmt.Errorf("error writing snapshot: %s", err)
+	}
+	if err := s.wal.Truncate(0); err != nil {
+		return fmt.Errorf("error truncating the write-ahead log: %s", err)
+	}
+	return s.wal.Sync()
+}
+
+func (s *store) close() {
+	if s != nil {
+		s.wal.Close()
+	}
+}
+
+// Directory holding the store of this central manager, several of them may share DataDir
+func (cm *CentralManager) storeDir() string {
+	return filepath.Join(cm.DataDir, strings.ReplaceAll(cm.IP, ":", "_"))
+}
+
+// Rebuilds the metadata from the snapshot and the write-ahead log in DataDir and keeps logging to them.
+// A raft replica loads its term, vote and log instead, and rebuilds the metadata by applying the log again.
+// Does nothing without a DataDir.
+func (cm *CentralManager) Restore() error {
+	if cm.DataDir == "" {
+		return nil
+	}
+	if cm.raft != nil {
+		return cm.raft.restore(cm.storeDir())
+	}
+	s, snapshot, entries, err := openStore(cm.storeDir())
+	if err != nil {
+		return err
+	}
+
+	cm.Lock.Lock()
+	cm.store.close()
+	cm.Records = snapshot.Records
+	cm.Queues = snapshot.Queues
+	cm.Transitions = snapshot.Transitions
+	cm.Members = snapshot.Members
+	cm.Lost = snapshot.Lost
+	cm.PageData = snapshot.PageData
+	cm.LastSeen = snapshot.LastSeen
+	cm.Pending = snapshot.Pending
+	cm.activeSince = time.Now() // The clients kept heartbeating while the process was down, so give them time to reach it again
+	cm.NextID = snapshot.NextID
+	cm.Seq = snapshot.Seq
+	cm.Epoch = snapshot.Epoch
+	for _, entry := range entries {
+		if entry.Seq <= cm.Seq {
+			continue
+		}
+		if entry.Seq != cm.Seq+1 {
+			fmt.Printf("[CENTRAL-MANAGER] Write-ahead log skips from mutation %d to %d, ignoring the rest\n", cm.Seq, entry.Seq)
+			break
+		}
+		cm.apply(entry.Mutation)
+		cm.Seq = entry.Seq
+		cm.Epoch = max(cm.Epoch, entry.Epoch)
+	}
+	cm.store = s
+	err = s.snapshot(cm.syncMessageLocked()) // Start over from a clean log
+	fmt.Printf("[CENTRAL-MANAGER] Restored %d records and %d members up to mutation %d from %s\n", len(cm.Records), len(cm.Members), cm.Seq, cm.storeDir())
+	cm.Lock.Unlock()
+	if err != nil {
+		return err
+	}
+
+	if !cm.IsBackup {
+		// The requests that were in flight died with the old process, their clients retry or time them out on their own
+		_, err = cm.commit(Mutation{Op: TAKEOVER})
+	}
+	return err
+}
+
+// Takes a snapshot of the metadata, which also empties the write-ahead log
+func (cm *CentralManager) Snapshot() error {
+	cm.Lock.Lock()
+	defer cm.Lock.Unlock()
+	return cm.store.snapshot(cm.syncMessageLocked())
+}
+
+// Function to take a snapshot every SnapshotInterval
+func (cm *CentralManager) StartSnapshots() {
+	for {
+		time.Sleep(cm.SnapshotInterval)
+		if err := cm.Snapshot(); err != nil {
+			fmt.Printf("[CENTRAL-MANAGER] Error occurred while taking a snapshot: %s\n", err)
+		}
+	}
+}
+
+// Stops serving for the given time, then rebuilds the metadata from DataDir as a restarted process would.
+// The lease goes with the process: it is not renewed while down, so a standby may take over, and it is only
+// held again once every standby has accepted a renewal sent after the reboot.
+func (cm *CentralManager) Reboot(downtime time.Duration) error {
+	cm.Lock.Lock()
+	cm.IsRebooting = true
+	cm.renewals = make(map[string]time.Time)
+	cm.Lock.Unlock()
+	defer func() {
+		cm.Lock.Lock()
+		cm.IsRebooting = false
+		cm.Lock.Unlock()
+	}()
+	cm.dropConnections() // Nothing is served while down, not even on the connections the peers already have open
+	if cm.DataDir != "" {
+		cm.raft.forget() // Before the metadata goes, so that nothing is applied to it in between
+		cm.Lock.Lock()
+		cm.Records = make(map[int]Record) // Everything in memory is lost
+		cm.Queues = make(map[int][]Request)
+		cm.Transitions = make(map[int]Transition)
+		cm.Members = make(map[int]string)
+		cm.Lost = make(map[int]bool)
+		cm.PageData = make(map[int][]byte)
+		cm.LastSeen = make(map[int]time.Time)
+		cm.Pending = make(map[string]Request)
+		cm.NextID = 0
+		cm.Lock.Unlock()
+	}
+	time.Sleep(downtime)
+	return cm.Restore()
+}
+
+// Checks if the central manager is down for a reboot, its loops and listener stand still meanwhile
+func (cm *CentralManager) rebooting() bool {
+	cm.Lock.Lock()
+	defer cm.Lock.Unlock()
+	return cm.IsRebooting
+}
+
+// Closes every connection being served
+func (cm *CentralManager) dropConnections() {
+	cm.Lock.Lock()
+	defer cm.Lock.Unlock()
+	for conn := range cm.conns {
+		conn.Close()
+	}
+}
@@ -0,0 +1,107 @@
+package CM
+
+import (
+	"ivy/utils"
+	"testing"
+	"time"
+)
+
+func TestRestoreFromDataDir(t *testing.T) {
+	mem := utils.NewMemory()
+	cfg := testConfig()
+	cfg.Primary = "10.0.2.1:7000"
+	cfg.DataDir = t.TempDir()
+	cm := NewCentralManager(cfg.Primary, cfg)
+	cm.UseTransport(mem)
+	if err := cm.Restore(); err != nil {
+		t.Fatalf("starting from an empty data directory: %s", err)
+	}
+	serve(t, cm)
+
+	a := openClient(t, cfg, mem, "10.0.2.2")
+	b := openClient(t, cfg, mem, "10.0.2.3")
+	if err := a.Write(0, []byte("A")); err != nil {
+		t.Fatal(err)
+	}
+	if err := cm.Snapshot(); err != nil {
+		t.Fatal(err)
+	}
+	// The rest only makes it to the write-ahead log
+	if _, err := b.Read(0, 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Write(cfg.PageSize, []byte("B")); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, time.Second, "the requests to complete", func() bool {
+		cm.Lock.Lock()
+		defer cm.Lock.Unlock()
+		return len(cm.Pending) == 0
+	})
+
+	restored := NewCentralManager(cfg.Primary, cfg)
+	if err := restored.Restore(); err != nil {
+		t.Fatalf("restoring: %s", err)
+	}
+	cm.Lock.Lock()
+	defer cm.Lock.Unlock()
+	if restored.Seq != cm.Seq+1 { // Restoring commits a TAKEOVER
+		t.Errorf("restored up to mutation %d, want %d", restored.Seq, cm.Seq+1)
+	}
+	if restored.NextID != cm.NextID || len(restored.Members) != len(cm.Members) {
+		t.Errorf("restored members %v and next id %d, want %v and %d", restored.Members, restored.NextID, cm.Members, cm.NextID)
+	}
+	if len(restored.Records) != len(cm.Records) {
+		t.Fatalf("restored %d records, want %d", len(restored.Records), len(cm.Records))
+	}
+	for pageID, record := range cm.Records {
+		got := restored.Records[pageID]
+		if got.Owner != record.Owner || len(got.Copies) != len(record.Copies) {
+			t.Errorf("page %d restored as %v, want %v", pageID, got, record)
+		}
+	}
+	if owner := restored.Records[0].Owner.ID; owner != a.ID {
+		t.Errorf("page 0 is owned by client %d, want the writer %d", owner, a.ID)
+	}
+	if copies := restored.Records[0].Copies; len(copies) != 1 || copies[0].ID != b.ID {
+		t.Errorf("page 0 has copies %v, want the reader %d", copies, b.ID)
+	}
+}
+
+func TestRebootLetsBackupTakeOver(t *testing.T) {
+	mem := utils.NewMemory()
+	cfg := testConfig()
+	cfg.Primary = "10.0.2.4:7000"
+	cfg.Backup = "10.0.2.5:7000"
+	cfg.DataDir = t.TempDir()
+	primary := NewCentralManager(cfg.Primary, cfg)
+	backup := NewCentralManager(cfg.Backup, cfg)
+	primary.UseTransport(mem)
+	backup.UseTransport(mem)
+	for _, cm := range []*CentralManager{primary, backup} {
+		if err := cm.Restore(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	serve(t, primary, backup)
+	go primary.HoldLease()
+	go primary.StartBackup()
+	go backup.HealthCheck()
+	go backup.HoldLease()
+	go backup.StartBackup()
+	waitFor(t, 2*time.Second, "the backup to be synced", backup.caughtUp)
+
+	// The rebooting primary stops renewing its lease, so the backup takes over while it is down
+	rebooted := make(chan error, 1)
+	go func() { rebooted <- primary.Reboot(4 * time.Duration(cfg.LeaseDuration)) }()
+	waitFor(t, 2*time.Second, "the backup to take over", backup.active)
+	if !primary.rebooting() {
+		t.Fatalf("the backup took over only after the reboot ended")
+	}
+	<-rebooted
+
+	// Back up, the primary does not serve in the epoch it had before the reboot
+	if err := primary.checkEpoch(0); err == nil && primary.CurrentEpoch() <= backup.CurrentEpoch() {
+		t.Errorf("the primary serves in epoch %d after the backup took over in %d", primary.CurrentEpoch(), backup.CurrentEpoch())
+	}
+}
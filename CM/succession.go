@@ -0,0 +1,75 @@
+package CM
+
+import (
+	"fmt"
+	"ivy/message"
+)
+
+// The primary and the backup central managers form an ordered succession.
+// Whichever of them is active ships its mutations to and renews its lease with all the others.
+// A backup only takes over once the lease has expired and every central manager ahead of it is down,
+// so exactly one of them declares itself through DeclareCM.
+
+// Addresses of the primary and the backups in order of succession
+func (cm *CentralManager) succession() []string {
+	return append([]string{cm.PrimaryIP}, cm.Backups...)
+}
+
+// The other central managers in the succession
+func (cm *CentralManager) others() []string {
+	var others []string
+	for _, ip := range cm.succession() {
+		if ip != cm.IP {
+			others = append(others, ip)
+		}
+	}
+	return others
+}
+
+// Whether this central manager is the one serving the clients
+func (cm *CentralManager) active() bool {
+	cm.Lock.Lock()
+	defer cm.Lock.Unlock()
+	return (!cm.IsBackup || cm.isDead) && !cm.fenced
+}
+
+// Whether this backup has taken over from the primary
+func (cm *CentralManager) tookOver() bool {
+	cm.Lock.Lock()
+	defer cm.Lock.Unlock()
+	return cm.isDead
+}
+
+// Checks a message from a central manager claiming to be active, must be called with the lock held.
+// Messages from an older epoch are refused, and a newer epoch means this central manager has been replaced
+// so it steps aside: a backup that had taken over goes back to standing by and the primary is fenced.
+func (cm *CentralManager) acceptActive(epoch int) error {
+	if epoch < cm.Epoch {
+		return staleEpoch(epoch, cm.Epoch)
+	}
+	if epoch == cm.Epoch && cm.isDead {
+		return fmt.Errorf("central manager %s has taken over in epoch %d", cm.IP, cm.Epoch)
+	}
+	if epoch > cm.Epoch {
+		cm.Epoch = epoch
+		if cm.isDead {
+			fmt.Printf("[CENTRAL-MANAGER] Another central manager is active in epoch %d, standing by again\n", epoch)
+			cm.isDead = false
+		}
+		if !cm.IsBackup && !cm.fenced {
+			fmt.Printf("[CENTRAL-MANAGER] Another central manager is active in epoch %d, stepping down until the metadata is synced\n", epoch)
+			cm.fenced = true
+		}
+	}
+	return nil
+}
+
+// Checks if any of the backups ahead of this one can still be reached, the primary is judged by its lease instead
+func (cm *CentralManager) aheadAlive() bool {
+	for _, ip := range cm.Backups[:max(cm.Rank-1, 0)] {
+		if _, err := cm.call(ip, "CentralManager.Ping", message.Message{Type: PING}); err == nil {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,109 @@
+package CM
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"ivy/message"
+	"ivy/utils"
+	"math/big"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Returns a certificate authority and a function issuing certificates for 127.0.0.1 signed by it
+func testAuthority(t *testing.T) (*x509.CertPool, func(unit string) tls.Certificate) {
+	t.Helper()
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caTmpl := &x509.Certificate{SerialNumber: big.NewInt(1), Subject: pkix.Name{CommonName: "ca"}, NotBefore: time.Now().Add(-time.Hour), NotAfter: time.Now().Add(time.Hour),
+		IsCA: true, BasicConstraintsValid: true, KeyUsage: x509.KeyUsageCertSign}
+	der, err := x509.CreateCertificate(rand.Reader, caTmpl, caTmpl, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caCert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(caCert)
+
+	issue := func(unit string) tls.Certificate {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tmpl := &x509.Certificate{SerialNumber: big.NewInt(time.Now().UnixNano()), Subject: pkix.Name{CommonName: unit, OrganizationalUnit: []string{unit}},
+			NotBefore: time.Now().Add(-time.Hour), NotAfter: time.Now().Add(time.Hour), IPAddresses: []net.IP{net.ParseIP("127.0.0.1")},
+			ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth}, KeyUsage: x509.KeyUsageDigitalSignature}
+		der, err := x509.CreateCertificate(rand.Reader, tmpl, caCert, &key.PublicKey, caKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+	}
+	return pool, issue
+}
+
+func TestTLSGuardsClients(t *testing.T) {
+	mem := utils.NewMemory()
+	pool, issue := testAuthority(t)
+	managers := utils.NewTLS(mem, issue(utils.MANAGER), pool)
+	clients := utils.NewTLS(mem, issue(utils.CLIENT), pool)
+
+	cfg := testConfig()
+	cfg.Primary = "127.0.0.1:7000"
+	cfg.Backup = ""
+	primary := NewCentralManager(cfg.Primary, cfg)
+	primary.UseTransport(managers)
+	serve(t, primary)
+
+	owner := openClient(t, cfg, clients, "127.0.0.1")
+	reader := openClient(t, cfg, clients, "127.0.0.1")
+	if err := owner.Write(0, []byte("A")); err != nil {
+		t.Fatalf("write: %s", err)
+	}
+
+	// Another client may not act as a central manager, nor push a page nobody asked for
+	rogue := utils.NewPool(clients)
+	ctx := context.Background()
+	refused := []struct {
+		addr   string
+		method string
+		msg    message.Message
+	}{
+		{cfg.Primary, "CentralManager.Backup", message.Message{}},
+		{owner.IP, "Client.ReceiveRequest", message.Message{Type: WRITE_FORWARD, ID: reader.ID, IP: reader.IP, PageID: 0}},
+		{owner.IP, "Client.ReceiveRequest", message.Message{Type: INVALIDATE_CACHE, PageID: 0}},
+		{reader.IP, "Client.ReceiveRequest", message.Message{Type: RECEIVE_PAGE, PageID: 0, Permission: WRITE, Data: []byte("forged")}},
+		{cfg.Primary, "CentralManager.ReceiveRequest", message.Message{Type: WRITE_CONFIRMATION, ID: owner.ID, IP: reader.IP, PageID: 0}},
+	}
+	for _, call := range refused {
+		_, err := rogue.Send(ctx, call.addr, call.method, call.msg)
+		if err == nil || !strings.Contains(err.Error(), utils.PERMISSION_DENIED) {
+			t.Errorf("%s %s from a client was not refused: %v", call.method, call.msg.Type, err)
+		}
+	}
+
+	// The pages the central manager has the owner forward still get through
+	data, err := reader.Read(0, 1)
+	if err != nil || string(data) != "A" {
+		t.Fatalf("read forwarded by the owner: %q %v", data, err)
+	}
+	if err := reader.Write(0, []byte("B")); err != nil {
+		t.Fatalf("write forwarded by the owner: %s", err)
+	}
+	data, err = owner.Read(0, 1)
+	if err != nil || string(data) != "B" {
+		t.Fatalf("read after the write: %q %v", data, err)
+	}
+}
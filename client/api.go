@@ -0,0 +1,359 @@
+package client
+
+import (
+	"fmt"
+	"ivy/config"
+	"ivy/message"
+	"ivy/utils"
+	"time"
+)
+
+// Config holds everything needed to bring up a client node
+type Config struct {
+	IP             string          // Address the client listens on, a free local port is picked when empty
+	ServerIP       string          // Address of the central manager
+	Backups        []string        // Addresses of the backup central managers, tried in order if the primary is down when joining
+	Replicas       []string        // Addresses of the raft replicas of the central manager, tried in turn when joining
+	RequestTimeout time.Duration   // How long a page fault may take
+	Heartbeat      time.Duration   // Time between heartbeats to the central manager
+	ClientTimeout  time.Duration   // How long the central manager waits for a heartbeat before evicting a client, the cache is not used for longer than that without one
+	NumPages       int             // Number of pages in the shared memory
+	PageSize       int             // Size of each page in bytes
+	Workload       config.Workload // Requests made when the central manager starts the workload
+	Mode           string          // Manager mode, config.CENTRAL, config.DYNAMIC or config.FIXED
+	Peers          []string        // Addresses of every client in dynamic mode, IP must be one of them
+	Managers       []string        // Addresses of the central managers in fixed mode, the client joins through the first one
+	ReplicatePages bool            // Push every written page to the central manager so that it survives a crash of this client
+	Transport      utils.Transport // Carries the RPCs to and from the other nodes, utils.TCP when nil
+}
+
+// Builds the client configuration out of the shared node configuration
+func NewConfig(cfg config.Config) Config {
+	return Config{
+		IP:             cfg.Listen,
+		ServerIP:       cfg.Primary,
+		Backups:        cfg.Standbys(),
+		Replicas:       cfg.Replicas,
+		RequestTimeout: time.Duration(cfg.RequestTimeout),
+		Heartbeat:      time.Duration(cfg.ClientHeartbeat),
+		ClientTimeout:  time.Duration(cfg.ClientTimeout),
+		NumPages:       cfg.NumPages,
+		PageSize:       cfg.PageSize,
+		Workload:       cfg.Workload,
+		Mode:           cfg.Mode,
+		Peers:          cfg.Peers,
+		Managers:       cfg.Managers,
+		ReplicatePages: cfg.ReplicatePages,
+	}
+}
+
+// Starts a client node, joins it to the network through the central manager and returns once it is ready to serve requests.
+// In dynamic mode there is no central manager and the client only listens on IP.
+// Fields left empty in cfg take their values from config.Default.
+func Open(cfg Config) (*Client, error) {
+	cfg = cfg.withDefaults()
+
+	c := &Client{
+		IP:                cfg.IP,
+		Cached:            make(map[int]Page),
+		ServerIP:          cfg.ServerIP,
+		StartTime:         time.Now(),
+		opened:            time.Now(),
+		RequestTimeout:    cfg.RequestTimeout,
+		HeartbeatInterval: cfg.Heartbeat,
+		ClientTimeout:     cfg.ClientTimeout,
+		acked:             make(map[string]time.Time),
+		NumPages:          cfg.NumPages,
+		PageSize:          cfg.PageSize,
+		NumRequests:       cfg.Workload.NumRequests,
+		RequestInterval:   time.Duration(cfg.Workload.RequestInterval),
+		ReadPercentage:    cfg.Workload.ReadPercentage,
+		Mode:              cfg.Mode,
+		Peers:             cfg.Peers,
+		Managers:          cfg.Managers,
+		ReplicatePages:    cfg.ReplicatePages,
+		faults:            make(map[int]*fault),
+		transport:         cfg.Transport,
+		pool:              utils.DefaultPool,
+		probOwner:         make(map[int]string),
+		copySet:           make(map[int][]string),
+		pushed:            make(map[int]int),
+	}
+
+	if c.transport != (utils.TCP{}) {
+		c.pool = utils.DefaultPool.WithTransport(c.transport) // The clients on TCP share their connections
+	}
+
+	if c.Mode == config.DYNAMIC {
+		// There is no central manager to join, the client id is the position in the peer list
+		c.ID = -1
+		for id, ip := range c.Peers {
+			if ip == c.IP {
+				c.ID = id
+			}
+		}
+		if c.ID == -1 {
+			return nil, fmt.Errorf("address %s is not one of the peers %v", c.IP, c.Peers)
+		}
+		listener, err := c.listen()
+		if err != nil {
+			return nil, fmt.Errorf("could not start listening: %s", err)
+		}
+		go c.serve(listener)
+		return c, nil
+	}
+	if c.Mode == config.FIXED {
+		c.ServerIP = c.Managers[0] // Keeps the membership and collects the averages
+	}
+
+	listener, err := c.listen()
+	if err != nil {
+		return nil, fmt.Errorf("could not start listening: %s", err)
+	}
+	c.IP = listener.Addr().String() // The port is only known now when it was picked by the OS
+
+	// Join through the primary central manager, falling back to the backups if it is down.
+	// With raft replicas only the leader accepts the join, so every replica is tried in turn.
+	// A standby only accepts it once it has taken over, so they are all tried again until one does or the request times out.
+	candidates := []string{c.ServerIP}
+	if c.Mode != config.FIXED {
+		if len(cfg.Replicas) > 0 {
+			candidates = cfg.Replicas
+		} else {
+			candidates = append(candidates, cfg.Backups...)
+		}
+	}
+	var reply message.Message
+	var joined time.Time
+	expiry := time.Now().Add(c.RequestTimeout)
+	for {
+		for _, ip := range candidates {
+			c.ServerIP = ip
+			joined = time.Now()
+			reply, err = c.call(c.ServerIP, "CentralManager.Join", message.Message{IP: c.IP})
+			if err == nil {
+				break
+			}
+		}
+		if err == nil || !retryable(err) || time.Now().Add(retryInterval).After(expiry) {
+			break
+		}
+		time.Sleep(retryInterval)
+	}
+	if err != nil {
+		listener.Close()
+		return nil, fmt.Errorf("error occurred while joining the network: %s", err)
+	}
+	c.ID = reply.ID
+	c.Epoch = reply.Epoch
+	for _, ip := range append([]string{c.ServerIP}, c.Managers...) {
+		c.acked[ip] = joined // Joining counts as the first heartbeat
+	}
+
+	go c.serve(listener)
+	go c.SendHeartbeats()
+	return c, nil
+}
+
+// Removes the client from the network's membership.
+// The contents of every cached page are handed back, so the central manager can pass the pages this client owns
+// to a copyholder or keep them itself. Leave returns once every central manager has dropped the client from its
+// records, and the client must not be used afterwards.
+func (c *Client) Leave() error {
+	if c.Mode == config.DYNAMIC {
+		return nil // Membership is fixed by the peer list
+	}
+	c.Lock.Lock()
+	c.left = true // No new page faults and no more heartbeats
+	c.Lock.Unlock()
+	c.waitForFaults() // A page still on its way would make this client an owner again
+
+	managers := []string{c.ServerIP}
+	if c.Mode == config.FIXED {
+		managers = c.Managers // Every partition keeps its own records
+	}
+	contents := make(map[string]map[int][]byte, len(managers))
+	c.Lock.Lock()
+	for pageID, page := range c.Cached {
+		ip := c.managerOf(pageID)
+		if contents[ip] == nil {
+			contents[ip] = make(map[int][]byte)
+		}
+		contents[ip][pageID] = c.newPageData(page.Data)
+	}
+	c.Lock.Unlock()
+
+	for _, ip := range managers {
+		_, err := c.call(ip, "CentralManager.Leave", message.Message{ID: c.ID, IP: c.IP, Contents: contents[ip], Epoch: c.currentEpoch()})
+		if err != nil {
+			return fmt.Errorf("error occurred while leaving the network: %s", err)
+		}
+	}
+
+	c.Lock.Lock()
+	c.Cached = make(map[int]Page)
+	c.Lock.Unlock()
+	return nil
+}
+
+// Fills in the zero fields from config.Default
+func (cfg Config) withDefaults() Config {
+	defaults := NewConfig(config.Default())
+	if cfg.IP == "" {
+		cfg.IP = config.LOCALHOST + "0"
+	}
+	if cfg.Mode == "" {
+		cfg.Mode = defaults.Mode
+	}
+	if cfg.ServerIP == "" {
+		cfg.ServerIP = defaults.ServerIP // assigning the primary central manager IP first
+	}
+	if cfg.RequestTimeout == 0 {
+		cfg.RequestTimeout = defaults.RequestTimeout
+	}
+	if cfg.Heartbeat == 0 {
+		cfg.Heartbeat = defaults.Heartbeat
+	}
+	if cfg.ClientTimeout == 0 {
+		cfg.ClientTimeout = defaults.ClientTimeout
+	}
+	if cfg.NumPages == 0 {
+		cfg.NumPages = defaults.NumPages
+	}
+	if cfg.PageSize == 0 {
+		cfg.PageSize = defaults.PageSize
+	}
+	if cfg.Workload == (config.Workload{}) {
+		cfg.Workload = defaults.Workload
+	}
+	if cfg.Transport == nil {
+		cfg.Transport = utils.TCP{}
+	}
+	return cfg
+}
+
+// Reads n bytes of shared memory starting at addr, faulting in pages with READ permission as needed.
+// Page faults that fail are returned as a *FaultError.
+func (c *Client) Read(addr int, n int) ([]byte, error) {
+	if err := c.checkRange(addr, n); err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, 0, n)
+	for n > 0 {
+		pageID, offset := addr/c.PageSize, addr%c.PageSize
+		size := min(n, c.PageSize-offset)
+
+		err := c.withPage(pageID, READ, func(page *Page) {
+			buf = append(buf, page.Data[offset:offset+size]...)
+		})
+		if err != nil {
+			return nil, err
+		}
+		addr += size
+		n -= size
+	}
+	return buf, nil
+}
+
+// Writes buf into shared memory starting at addr, faulting in pages with WRITE permission as needed.
+// With ReplicatePages every modified page is pushed to the central manager before Write returns.
+func (c *Client) Write(addr int, buf []byte) error {
+	if err := c.checkRange(addr, len(buf)); err != nil {
+		return err
+	}
+
+	for len(buf) > 0 {
+		pageID, offset := addr/c.PageSize, addr%c.PageSize
+		size := min(len(buf), c.PageSize-offset)
+
+		var update *pageUpdate
+		err := c.withPage(pageID, WRITE, func(page *Page) {
+			copy(page.Data[offset:], buf[:size])
+			if c.ReplicatePages && c.Mode != config.DYNAMIC {
+				update = c.pageUpdate(page)
+			}
+		})
+		if err != nil {
+			return err
+		}
+		if update != nil {
+			if err := c.replicate(update); err != nil {
+				return fmt.Errorf("page %d was written but could not be replicated: %s", pageID, err)
+			}
+		}
+		addr += size
+		buf = buf[size:]
+	}
+	return nil
+}
+
+// Runs fn on the cached page once the client holds it with the given permission.
+// A cached page is not used while the central manager may have evicted this client for missing heartbeats,
+// since it may have handed the page to another client meanwhile. It waits for a heartbeat to get through instead,
+// and fails with ErrFailover if none does within RequestTimeout.
+func (c *Client) withPage(pageID int, permission string, fn func(page *Page)) error {
+	expiry := time.Now().Add(c.RequestTimeout)
+	for {
+		c.Lock.Lock()
+		if c.hasPermission(pageID, permission) {
+			if !c.inTouch(pageID) {
+				c.Lock.Unlock()
+				if time.Now().After(expiry) {
+					return &FaultError{PageID: pageID, Permission: permission, Err: ErrFailover}
+				}
+				time.Sleep(retryInterval)
+				continue
+			}
+			page := c.Cached[pageID]
+			fn(&page)
+			c.Lock.Unlock()
+			return nil
+		}
+		c.Lock.Unlock()
+
+		// The page can be invalidated again before we get the lock back, so keep faulting until it sticks
+		if err := c.fault(pageID, permission); err != nil {
+			return err
+		}
+	}
+}
+
+// Contents of a written page waiting to be pushed to its central manager
+type pageUpdate struct {
+	seq    int // Orders the writes, every one of them pushes everything written before it
+	target string
+	msg    message.Message
+}
+
+// Captures the page for replicate, must be called with the lock held
+func (c *Client) pageUpdate(page *Page) *pageUpdate {
+	c.updates++
+	msg := message.Message{Type: PAGE_UPDATE, ID: c.ID, IP: c.IP, PageID: page.ID, Data: c.newPageData(page.Data), Epoch: c.Epoch}
+	return &pageUpdate{seq: c.updates, target: c.managerOf(page.ID), msg: msg}
+}
+
+// Pushes the written page to its central manager, which keeps it in case this client dies.
+// The push is made without the lock so that the page stays available while it goes out. Pushes go out one at a time,
+// and one that has been overtaken by a later write is skipped since that write pushed the same contents and more.
+func (c *Client) replicate(update *pageUpdate) error {
+	c.pushLock.Lock()
+	defer c.pushLock.Unlock()
+	if c.pushed[update.msg.PageID] > update.seq {
+		return nil
+	}
+	_, err := c.call(update.target, "CentralManager.ReceiveRequest", update.msg)
+	if err != nil {
+		return err
+	}
+	c.pushed[update.msg.PageID] = update.seq
+	return nil
+}
+
+// Makes sure the range [addr, addr+n) lies inside the shared memory
+func (c *Client) checkRange(addr int, n int) error {
+	if addr < 0 || n < 0 || addr+n > c.NumPages*c.PageSize {
+		return fmt.Errorf("address range [%d, %d) is outside the shared memory of %d bytes", addr, addr+n, c.NumPages*c.PageSize)
+	}
+	return nil
+}
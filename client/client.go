@@ -1,35 +1,65 @@
 package client
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"ivy/config"
 	"ivy/message"
 	"ivy/utils"
 	"math/rand"
 	"net"
 	"net/rpc"
 	"os"
+	"strings"
 	"sync"
 	"time"
 )
 
-var (
-	totalReadTime float64
-	totalWriteTime float64
-	count map[string]int = make(map[string]int)
-)
-
 type Client struct {
 	ID     int
 	IP     string
 	Cached map[int]Page
 	StartTime time.Time
 	ServerIP string
+	Epoch int // Newest central manager epoch seen, messages from older epochs are rejected
 	Lock sync.Mutex
+	RequestTimeout time.Duration // How long a page fault waits for its page
+	HeartbeatInterval time.Duration // Time between heartbeats to the central manager
+	ClientTimeout time.Duration // How long the central manager waits for a heartbeat before it evicts this client
+	acked map[string]time.Time // Map of central manager IP to when the last heartbeat it answered was sent, guarded by Lock
+	NumPages int // Number of pages in the system
+	PageSize int // Size of each page in bytes
+	NumRequests int // Number of requests made by RequestPage
+	RequestInterval time.Duration // Time interval between requests
+	ReadPercentage int // Percentage of READ requests made by RequestPage
+	Mode string // Manager mode, config.CENTRAL, config.DYNAMIC or config.FIXED
+	ReplicatePages bool // Push the contents of every written page to the central manager so that they survive this client
+	Managers []string // IPs of the central managers sharing the pages in fixed mode
+	Peers []string // IPs of every client in dynamic mode, the first one initially owns all pages
+	probOwner map[int]string // Probable owner of each page in dynamic mode
+	copySet map[int][]string // IPs of the clients holding a copy of each page this client owns in dynamic mode
+	faults map[int]*fault // Outstanding page faults keyed by page id
+	requests int // Number of page requests made so far, numbers the request ids
+	opened time.Time // When the client was opened, keeps the request ids of a restarted client apart from the old ones
+	left bool // Set once Leave has started, the client makes no more requests
+	evicted bool // Set once the central manager has refused a heartbeat, the cache was dropped
+	updates int // Number of writes to be pushed to the central manager, orders the pushes
+	pushed map[int]int // Map of page id to the newest write pushed to the central manager, guarded by pushLock
+	pushLock sync.Mutex // Held while pushing a page, so that an older push cannot overwrite a newer one
+	server *rpc.Server // Own RPC server so that several clients can live in one process
+	transport utils.Transport // Carries the RPCs to and from the other nodes
+	pool *utils.Pool // Connections to the other nodes over transport
+	totalReadTime float64 // Seconds taken by the READ requests served so far, guarded by Lock
+	totalWriteTime float64 // Seconds taken by the WRITE requests served so far, guarded by Lock
+	reads int // Number of READ requests served so far, guarded by Lock
+	writes int // Number of WRITE requests served so far, guarded by Lock
 }
 
 type Page struct {
 	ID        int    // Page number
 	Permission string // READ | WRITE
+	Data      []byte // Contents of the page, always PageSize bytes long
 }
 
 const (
@@ -43,50 +73,112 @@ const (
 	WRITE_CONFIRMATION = "WRITE_CONFIRMATION"
 	READ_CONFIRMATION = "READ_CONFIRMATION"
 	INVALIDATE_CACHE = "INVALIDATE_CACHE"
+	STALE_EPOCH = "stale central manager epoch"
 	INVALIDATE_CONFIRMATION = "INVALIDATE_CONFIRMATION"
-	NUM_PAGES = 4 // Number of pages in the system
-	LOCALHOST = "127.0.0.1:"
-	CENTRALIP = LOCALHOST + "8000"
-	BACKUPIP  = LOCALHOST + "8001"
-	NUMREQUESTS = 10
+	PAGE_NOT_FOUND = "page not found in any of the clients"
+	PAGE_LOST = "page was lost with the client that owned it"
+	PAGE_UPDATE = "PAGE_UPDATE"
+	HEARTBEAT = "HEARTBEAT"
+	NOT_MEMBER = "client is not a member of the network"
+	NOT_LEADER = "this central manager is not the raft leader"
 	RED = "\033[31m"  // ANSI code for red text
+	GREEN = "\033[32m" // ANSI code for green text
 	RESET = "\033[0m" // ANSI code to reset color
-	timeInterval = 10 // Time interval between requests
 )
 
+// RPCs that only the central managers may make, checked when the nodes authenticate with certificates
+var managerOnly = map[string]bool{
+	"Client.UpdateServerIP": true,
+	"Client.ReportPages": true,
+}
+
+// Checks the messages a client authenticated with a certificate sends to this one.
+// Forwards, lost pages and invalidations come from the central managers,
+// except that in dynamic mode the clients ask each other for pages and invalidate each other's copies.
+// A page only comes from another client in answer to the pending request of this client for it.
+func (c *Client) guard(peer utils.Peer, method string, args interface{}) error {
+	msg, ok := args.(*message.Message)
+	if !ok || peer.Role == utils.MANAGER || method != "Client.ReceiveRequest" {
+		return nil
+	}
+	switch msg.Type {
+	case READ_FORWARD, WRITE_FORWARD, PAGE_LOST:
+		return fmt.Errorf("%s is only sent by central managers", msg.Type)
+	case READ, WRITE, INVALIDATE_CACHE:
+		if c.Mode != config.DYNAMIC {
+			return fmt.Errorf("%s is only sent by central managers", msg.Type)
+		}
+	case RECEIVE_PAGE:
+		c.Lock.Lock()
+		f, pending := c.faults[msg.PageID]
+		c.Lock.Unlock()
+		if !pending || f.RequestID != msg.RequestID || f.Permission != msg.Permission {
+			return fmt.Errorf("page %d with %s permission was not requested", msg.PageID, msg.Permission)
+		}
+	}
+	return nil
+}
+
+// Checks if a page sent with the call that returned err certainly did not reach the other client:
+// it could not be reached at all, or it refused the page before taking it
+func undelivered(err error) bool {
+	return utils.IsUnreachable(err) && !utils.IsTimeout(err) || strings.Contains(err.Error(), utils.PERMISSION_DENIED)
+}
+
 // Function to start the RPC server
 func (c *Client) StartRPCServer() {
-	rpc.Register(c)
-
-	listener, err := net.Listen("tcp", c.IP)
+	listener, err := c.listen()
 	if err != nil {
 		fmt.Printf("[NODE-%d] could not start listening: %s\n", c.ID, err)
 		os.Exit(1)
 	}
+	c.serve(listener)
+}
+
+// Registers the client for RPC and opens its listener
+func (c *Client) listen() (net.Listener, error) {
+	c.server = rpc.NewServer()
+	if err := c.server.Register(c); err != nil {
+		return nil, err
+	}
+	return c.transport.Listen(c.IP)
+}
+
+// Accepts and serves incoming RPC connections until the listener is closed
+func (c *Client) serve(listener net.Listener) {
 	defer listener.Close()
 
 	fmt.Printf("[NODE-%d] Node is running on %s\n", c.ID, c.IP)
 
 	for {
 		conn, err := listener.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
 		if err != nil {
 			fmt.Printf("[NODE-%d] accept error: %s\n", c.ID, err)
 			continue
 		}
-		go rpc.ServeConn(conn)
+		go utils.ServeConn(c.server, conn, managerOnly, c.guard)
 	}
 }
 
-// Function to request for read/write access for a page from the central server
+// Function to request for read/write access for a page from the central server.
+// The requests run in the background, so the call returns right away however long the workload takes.
 func (c *Client)RequestPage(msg message.Message, reply *message.Message) error {
-	for i := 0; i < NUMREQUESTS; i++ {
+	go c.runRequests()
+	return nil
+}
+
+// Makes NumRequests random read and write requests and reports the average time they took
+func (c *Client) runRequests() {
+	for i := 0; i < c.NumRequests; i++ {
 
 		// coin flip to choose read or write request
-		// requestType := c.coinFlip() // randomized flip
-		// requestType := c.percentageBasedFlip(90) // 90% read and 10% write(read-intensive workload)
-		requestType := c.percentageBasedFlip(10) // 10% read and 90% write(write-intensive workload)
+		// 50 gives a randomized flip, 90 a read-intensive and 10 a write-intensive workload
+		requestType := c.percentageBasedFlip(c.ReadPercentage)
 		// Randomly choose a page to read/write
-		pageID := rand.Intn(NUM_PAGES)
+		pageID := rand.Intn(c.NumPages)
 
 		c.StartTime = time.Now()
 		switch requestType {
@@ -97,7 +189,7 @@ func (c *Client)RequestPage(msg message.Message, reply *message.Message) error {
 					break
 				}
 
-				_, err := utils.CallByRPC(c.ServerIP, "CentralManager.ReceiveRequest", message.Message{Type: READ, ID: c.ID, IP: c.IP, PageID: pageID})
+				err := c.fault(pageID, READ)
 				if err != nil {
 					fmt.Printf("[NODE-%d] Error occurred while requesting READ access for page %d: %s\n", c.ID, pageID, err)
 				}
@@ -109,62 +201,102 @@ func (c *Client)RequestPage(msg message.Message, reply *message.Message) error {
 					break
 				}
 				
-				_, err := utils.CallByRPC(c.ServerIP, "CentralManager.ReceiveRequest", message.Message{Type: WRITE, ID: c.ID, IP: c.IP, PageID: pageID})
+				err := c.fault(pageID, WRITE)
 				if err != nil {
 					fmt.Printf("[NODE-%d] Error occurred while requesting WRITE access for page %d: %s\n", c.ID, pageID, err)
 				}
 		}
-		time.Sleep(timeInterval * time.Second)
+		time.Sleep(c.RequestInterval)
 	}
 	// Exit the program once all the requests are done
 	fmt.Printf("[NODE-%d] All requests are done\n", c.ID)
 	var avgReadTime float64 = 0
 	var avgWriteTime float64 = 0
-	if count[READ] != 0 {
-		avgReadTime = totalReadTime/float64(count[READ])
+	c.Lock.Lock()
+	if c.reads != 0 {
+		avgReadTime = c.totalReadTime/float64(c.reads)
+	}
+	if c.writes != 0 {
+		avgWriteTime = c.totalWriteTime/float64(c.writes)
 	}
-	if count[WRITE] != 0 {
-		avgWriteTime = totalWriteTime/float64(count[WRITE])
+	c.Lock.Unlock()
+	if c.Mode == config.DYNAMIC {
+		// There is no central manager to collect the averages
+		fmt.Printf(GREEN + "[NODE-%d] Average read time: %f ms\n" + RESET, c.ID, avgReadTime * 1000)
+		fmt.Printf(GREEN + "[NODE-%d] Average write time: %f ms\n" + RESET, c.ID, avgWriteTime * 1000)
+		return
 	}
-	_, err := utils.CallByRPC(c.ServerIP, "CentralManager.CalculateAverageResponseTime", message.Message{AvgReadPerNode: avgReadTime, AvgWritePerNode: avgWriteTime})
+	_, err := c.call(c.ServerIP, "CentralManager.CalculateAverageResponseTime", message.Message{AvgReadPerNode: avgReadTime, AvgWritePerNode: avgWriteTime})
 	if err != nil {
 		fmt.Printf("[NODE-%d] Error occurred while sending the average read and write time to the central manager: %s\n", c.ID, err)
 	}
-	return nil
+}
+
+// Adds the time taken by the request being served to the totals that runRequests averages
+func (c *Client) recordTime(permission string) {
+	c.Lock.Lock()
+	defer c.Lock.Unlock()
+	elapsed := time.Since(c.StartTime).Seconds()
+	if permission == WRITE {
+		c.totalWriteTime += elapsed
+		c.writes++
+	} else {
+		c.totalReadTime += elapsed
+		c.reads++
+	}
 }
 
 func (c *Client) ReceiveRequest(msg message.Message, reply *message.Message) error {
+	if err := c.checkEpoch(msg.Epoch); err != nil {
+		return err
+	}
+
 	switch msg.Type {
 	case RECEIVE_PAGE:
 		fmt.Printf("[NODE-%d] Received page %d with permission %s\n", c.ID, msg.PageID, msg.Permission)
+		permission := msg.Permission
+		if c.Mode == config.DYNAMIC {
+			permission = READ // Not writable until the copies are invalidated
+		}
 		c.Lock.Lock()
-		c.Cached[msg.PageID] = Page{ID: msg.PageID, Permission: msg.Permission}
+		c.Cached[msg.PageID] = Page{ID: msg.PageID, Permission: permission, Data: c.newPageData(msg.Data)}
 		fmt.Printf("[NODE-%d] Updated cache: %v\n", c.ID, c.Cached)
 		c.Lock.Unlock()
+		defer c.completeFault(msg.PageID, nil) // Only wake up the callers once the central manager knows about the transfer
 
-		if msg.Permission == WRITE {
+		if c.Mode == config.DYNAMIC {
+			// No central manager to confirm with, take over the probable owner hint instead
+			if err := c.receiveDynamicPage(msg); err != nil {
+				fmt.Printf("[NODE-%d] Page %d stays read-only: %s\n", c.ID, msg.PageID, err)
+				c.completeFault(msg.PageID, err)
+			}
+		} else if msg.Permission == WRITE {
 			// Send the confirmation to the central manager
-			_, err := utils.CallByRPC(c.ServerIP, "CentralManager.ReceiveRequest", message.Message{Type: WRITE_CONFIRMATION, ID: c.ID, IP: c.IP, PageID: msg.PageID})
+			err := c.confirm(message.Message{Type: WRITE_CONFIRMATION, ID: c.ID, IP: c.IP, PageID: msg.PageID, RequestID: msg.RequestID})
 			if err != nil {
 				return fmt.Errorf("error occurred while calling the central manager: %s", err)
 			}
-			totalWriteTime += float64(time.Since(c.StartTime).Seconds())
+			c.recordTime(WRITE)
 		} else {
 			// Send the confirmation to the central manager
-			_, err := utils.CallByRPC(c.ServerIP, "CentralManager.ReceiveRequest", message.Message{Type: READ_CONFIRMATION, ID: c.ID, IP: c.IP, PageID: msg.PageID})
+			err := c.confirm(message.Message{Type: READ_CONFIRMATION, ID: c.ID, IP: c.IP, PageID: msg.PageID, RequestID: msg.RequestID})
 			if err != nil {
 				return fmt.Errorf("error occurred while calling the central manager: %s", err)
 			}
-			totalReadTime += float64(time.Since(c.StartTime).Seconds())
+			c.recordTime(READ)
 		}
 
-		if _, ok := count[msg.Permission]; !ok {
-			count[msg.Permission] = 0
-		}
-
-		count[msg.Permission]++
 		fmt.Printf(RED + "[NODE-%d] Total time taken for the request: %v\n" + RESET, c.ID, time.Since(c.StartTime))
 
+	case PAGE_LOST:
+		// The owner of the page died and nobody else had it
+		fmt.Printf("[NODE-%d] Page %d was lost with the client that owned it\n", c.ID, msg.PageID)
+		c.completeFault(msg.PageID, ErrPageLost)
+
+	case READ, WRITE:
+		// Page faults from other clients only come in dynamic mode
+		return c.handleDynamicRequest(msg)
+
 	case READ_FORWARD:
 		// Forward the read request to the client
 		fmt.Printf("[NODE-%d] Forwarding READ permission for page %d to the client %d\n", c.ID, msg.PageID, msg.ID)
@@ -172,10 +304,12 @@ func (c *Client) ReceiveRequest(msg message.Message, reply *message.Message) err
 		msg.Permission = READ
 
 		c.Lock.Lock()
-		c.Cached[msg.PageID] = Page{ID: msg.PageID, Permission: READ} // Making sure that the perms for that page is set to READ
+		page := c.Cached[msg.PageID]
+		msg.Data = c.newPageData(page.Data) // Send a copy of the current contents to the reader
+		c.Cached[msg.PageID] = Page{ID: msg.PageID, Permission: READ, Data: page.Data} // Making sure that the perms for that page is set to READ
 		c.Lock.Unlock()
 
-		_, err := utils.CallByRPC(msg.IP, "Client.ReceiveRequest", msg)
+		_, err := c.call(msg.IP, "Client.ReceiveRequest", msg)
 		if err != nil {
 			return fmt.Errorf("error occurred while calling the client: %s", err)
 		}
@@ -186,15 +320,30 @@ func (c *Client) ReceiveRequest(msg message.Message, reply *message.Message) err
 		msg.Type = RECEIVE_PAGE
 		msg.Permission = WRITE
 
-		_, err := utils.CallByRPC(msg.IP, "Client.ReceiveRequest", msg)
-		if err != nil {
-			fmt.Printf("error occurred while calling the client: %s\n", err)
-		}
-
 		c.Lock.Lock()
-		delete(c.Cached, msg.PageID) // Invalidate the cache from the owner
+		page, ok := c.Cached[msg.PageID]
+		if !ok {
+			// Already handed over, e.g. by a central manager that failed over before it could record the new owner
+			c.Lock.Unlock()
+			return fmt.Errorf("page %d is not cached by client %d", msg.PageID, c.ID)
+		}
+		msg.Data = c.newPageData(page.Data) // Hand over the current contents to the new owner
+		delete(c.Cached, msg.PageID) // Invalidate the cache from the owner before the new owner can write to it
 		c.Lock.Unlock()
 
+		_, err := c.call(msg.IP, "Client.ReceiveRequest", msg)
+		if err != nil {
+			if undelivered(err) {
+				// The new owner did not get the page, so keep it rather than lose the only copy
+				c.Lock.Lock()
+				if _, ok := c.Cached[msg.PageID]; !ok {
+					c.Cached[msg.PageID] = page
+				}
+				c.Lock.Unlock()
+			}
+			return fmt.Errorf("error occurred while sending page %d to client %d: %s", msg.PageID, msg.ID, err)
+		}
+
 		fmt.Printf("[NODE-%d] Updated cache: %v\n", c.ID, c.Cached)
 
 	case INVALIDATE_CACHE:
@@ -203,10 +352,16 @@ func (c *Client) ReceiveRequest(msg message.Message, reply *message.Message) err
 
 		c.Lock.Lock()
 		delete(c.Cached, msg.PageID) // removed the cached page from the client
+		if c.Mode == config.DYNAMIC {
+			c.probOwner[msg.PageID] = msg.IP // The invalidation comes from the new owner
+		}
 		c.Lock.Unlock()
-		
+
+		if c.Mode == config.DYNAMIC {
+			return nil
+		}
 		// Send the confirmation to the central manager
-		_, err := utils.CallByRPC(c.ServerIP, "CentralManager.ReceiveRequest", message.Message{Type: INVALIDATE_CONFIRMATION, ID: c.ID, IP: c.IP, PageID: msg.PageID})
+		_, err := c.call(c.managerOf(msg.PageID), "CentralManager.ReceiveRequest", message.Message{Type: INVALIDATE_CONFIRMATION, ID: c.ID, IP: c.IP, PageID: msg.PageID, Epoch: c.currentEpoch()})
 		if err != nil {
 			return fmt.Errorf("error occurred while calling the central manager: %s", err)
 		}
@@ -215,11 +370,164 @@ func (c *Client) ReceiveRequest(msg message.Message, reply *message.Message) err
 }
 
 // Updating the server IP one of the CMs are down
+// Announcements from an older epoch come from a central manager that has already been replaced and are ignored.
 func (c *Client) UpdateServerIP(msg message.Message, reply *message.Message) error {
+	if err := c.checkEpoch(msg.Epoch); err != nil {
+		return err
+	}
+	c.Lock.Lock()
+	changed := c.ServerIP != msg.IP
 	c.ServerIP = msg.IP
+	c.Lock.Unlock()
+	if changed {
+		c.retryFaults() // The new central manager may have no record of the pending requests
+	}
 	return nil
 }
 
+// Function to keep telling the central manager that this client is alive, so that it is not skipped as dead
+func (c *Client) SendHeartbeats() {
+	for {
+		c.Lock.Lock()
+		left := c.left
+		managers := []string{c.ServerIP} // Changed by UpdateServerIP on failover
+		c.Lock.Unlock()
+		if left {
+			return
+		}
+		if c.Mode == config.FIXED {
+			managers = c.Managers // Every partition forwards requests to this client
+		}
+		for _, ip := range managers {
+			go func() {
+				sent := time.Now()
+				_, err := c.call(ip, "CentralManager.ReceiveRequest", message.Message{Type: HEARTBEAT, ID: c.ID, IP: c.IP, Epoch: c.currentEpoch()}) // A missed heartbeat is made up by the next one
+				if err == nil {
+					c.heardFrom(ip, sent)
+				} else if strings.Contains(err.Error(), NOT_MEMBER) {
+					c.evict()
+				}
+			}()
+		}
+		time.Sleep(c.HeartbeatInterval)
+	}
+}
+
+// Records that the central manager answered a heartbeat sent at the given time
+func (c *Client) heardFrom(ip string, sent time.Time) {
+	c.Lock.Lock()
+	defer c.Lock.Unlock()
+	if sent.After(c.acked[ip]) {
+		c.acked[ip] = sent
+	}
+}
+
+// Checks if the central manager of the page cannot have evicted this client yet, must be called with the lock held.
+// It only evicts a client it has not heard from for ClientTimeout, which it times from when the heartbeat arrived,
+// so timing it from when the heartbeat was sent is on the safe side. There are no heartbeats in dynamic mode.
+func (c *Client) inTouch(pageID int) bool {
+	if c.Mode == config.DYNAMIC {
+		return true
+	}
+	return time.Since(c.acked[c.managerOf(pageID)]) < c.ClientTimeout
+}
+
+// Drops the cache after the central manager has evicted this client, since the pages in it may have been
+// handed to other clients and written since. The client stops like one that has left.
+func (c *Client) evict() {
+	c.Lock.Lock()
+	if c.evicted {
+		c.Lock.Unlock()
+		return
+	}
+	fmt.Printf("[NODE-%d] Evicted by the central manager, dropping the cache\n", c.ID)
+	c.evicted = true
+	c.left = true
+	c.Cached = make(map[int]Page)
+	faults := make(map[int]*fault, len(c.faults))
+	for pageID, f := range c.faults {
+		faults[pageID] = f
+	}
+	c.Lock.Unlock()
+
+	for pageID, f := range faults {
+		c.resolveFault(pageID, f, ErrEvicted)
+	}
+}
+
+// RPC called by a recovering central manager to learn which pages this client holds.
+// It only reads the cache, so it is answered whatever the epoch of the caller.
+func (c *Client) ReportPages(msg message.Message, reply *message.Message) error {
+	c.Lock.Lock()
+	defer c.Lock.Unlock()
+	pages := make(map[int]string, len(c.Cached))
+	for pageID, page := range c.Cached {
+		pages[pageID] = page.Permission
+	}
+	*reply = message.Message{ID: c.ID, IP: c.IP, Pages: pages, Epoch: c.Epoch}
+	return nil
+}
+
+// Rejects messages from an older central manager epoch and moves on to newer ones
+func (c *Client) checkEpoch(epoch int) error {
+	c.Lock.Lock()
+	defer c.Lock.Unlock()
+	if epoch < c.Epoch {
+		return fmt.Errorf("%s: got epoch %d, current epoch is %d", STALE_EPOCH, epoch, c.Epoch)
+	}
+	c.Epoch = epoch
+	return nil
+}
+
+func (c *Client) currentEpoch() int {
+	c.Lock.Lock()
+	defer c.Lock.Unlock()
+	return c.Epoch
+}
+
+// Sends a confirmation to the central manager of the page.
+// Like the request it confirms, it is sent again to the current central manager while that cannot be reached or is not serving.
+func (c *Client) confirm(msg message.Message) error {
+	expiry := time.Now().Add(c.RequestTimeout)
+	for {
+		c.Lock.Lock()
+		target := c.managerOf(msg.PageID)
+		msg.Epoch = c.Epoch
+		c.Lock.Unlock()
+		_, err := c.call(target, "CentralManager.ReceiveRequest", msg)
+		if err == nil || !retryable(err) || time.Now().Add(retryInterval).After(expiry) {
+			return err
+		}
+		c.followLeader(err)
+		time.Sleep(retryInterval)
+	}
+}
+
+// Sends msg to the method on another node over the transport of this client, with the deadline configured for the type of msg
+func (c *Client) call(ip string, method string, msg message.Message) (message.Message, error) {
+	return c.pool.Send(context.Background(), ip, method, msg)
+}
+
+// Returns the central manager in charge of the page
+func (c *Client) managerOf(pageID int) string {
+	if c.Mode == config.FIXED {
+		return c.Managers[pageID%len(c.Managers)]
+	}
+	return c.ServerIP
+}
+
+// Keeps the cache printouts readable by leaving out the page contents
+func (p Page) String() string {
+	return fmt.Sprintf("{%d %s}", p.ID, p.Permission)
+}
+
+// Returns a PageSize buffer holding a copy of data, zero filled if data is empty
+func (c *Client) newPageData(data []byte) []byte {
+	buf := make([]byte, c.PageSize)
+	copy(buf, data)
+	return buf
+}
+
 // coin flip to choose read or write request
 func (c *Client) coinFlip() string{
 	rand.Seed(time.Now().UnixNano()) // Making sure this is random using a unique seed
@@ -0,0 +1,161 @@
+package client
+
+import (
+	"fmt"
+	"ivy/message"
+	"strings"
+	"time"
+)
+
+// Dynamic distributed manager mode, as described in the Ivy paper.
+// There is no central manager: every client keeps a probable owner hint per page and
+// page faults are forwarded along the chain of hints until they reach the real owner.
+// The owner of a page keeps its copy set and hands it over to the next writer,
+// who then invalidates the copies itself. Initially the first peer owns every page.
+
+// Returns the probable owner of the page, must be called with the lock held
+func (c *Client) probOwnerOf(pageID int) string {
+	if owner, ok := c.probOwner[pageID]; ok {
+		return owner
+	}
+	return c.Peers[0] // The default owner of every page
+}
+
+// Serves a READ or WRITE fault if this client owns the page, otherwise forwards it to the probable owner
+func (c *Client) handleDynamicRequest(msg message.Message) error {
+	if msg.IP != c.IP {
+		c.waitForOwnFault(msg.PageID)
+	}
+
+	c.Lock.Lock()
+	owner := c.probOwnerOf(msg.PageID)
+	if owner != c.IP {
+		// Not the owner, pass the request along the chain
+		if msg.Type == WRITE && msg.IP != c.IP {
+			c.probOwner[msg.PageID] = msg.IP // The writer is about to become the owner
+		}
+		c.Lock.Unlock()
+
+		fmt.Printf("[NODE-%d] Forwarding %s request for page %d from client %d to %s\n", c.ID, msg.Type, msg.PageID, msg.ID, owner)
+		_, err := c.call(owner, "Client.ReceiveRequest", msg)
+		if err != nil {
+			return fmt.Errorf("error occurred while forwarding to the probable owner: %s", err)
+		}
+		return nil
+	}
+
+	page, ok := c.Cached[msg.PageID]
+	if !ok {
+		// Nobody has touched this page yet, so the default owner creates it
+		page = Page{ID: msg.PageID, Permission: WRITE, Data: c.newPageData(nil)}
+	}
+	reply := message.Message{Type: RECEIVE_PAGE, ID: c.ID, IP: c.IP, PageID: msg.PageID, Permission: msg.Type, Data: c.newPageData(page.Data), RequestID: msg.RequestID}
+	copies := c.copySet[msg.PageID]
+
+	switch msg.Type {
+	case READ:
+		fmt.Printf("[NODE-%d] Sending READ permission for page %d to the client %d\n", c.ID, msg.PageID, msg.ID)
+		c.Cached[msg.PageID] = Page{ID: msg.PageID, Permission: READ, Data: page.Data} // The owner keeps a read-only copy
+		if msg.IP != c.IP {
+			c.copySet[msg.PageID] = append(c.copySet[msg.PageID], msg.IP)
+		}
+	case WRITE:
+		fmt.Printf("[NODE-%d] Sending WRITE permission for page %d to the client %d\n", c.ID, msg.PageID, msg.ID)
+		for _, ip := range c.copySet[msg.PageID] {
+			if ip != msg.IP {
+				reply.CopySet = append(reply.CopySet, ip) // The new owner invalidates the copies
+			}
+		}
+		delete(c.copySet, msg.PageID)
+		delete(c.Cached, msg.PageID)
+		c.probOwner[msg.PageID] = msg.IP
+	}
+	c.Lock.Unlock()
+
+	_, err := c.call(msg.IP, "Client.ReceiveRequest", reply)
+	if err != nil {
+		if msg.Type == WRITE && undelivered(err) {
+			// The writer did not get the page, so stay the owner rather than lose the only copy
+			c.Lock.Lock()
+			if _, ok := c.Cached[msg.PageID]; !ok {
+				c.Cached[msg.PageID] = page
+				c.copySet[msg.PageID] = copies
+				c.probOwner[msg.PageID] = c.IP
+			}
+			c.Lock.Unlock()
+		}
+		return fmt.Errorf("error occurred while calling the client: %s", err)
+	}
+	return nil
+}
+
+// Takes over a page sent by its owner in dynamic mode.
+// A page sent for writing arrives read-only, and only becomes writable once every copy handed over with it is invalidated.
+func (c *Client) receiveDynamicPage(msg message.Message) error {
+	if msg.Permission != WRITE {
+		c.Lock.Lock()
+		c.probOwner[msg.PageID] = msg.IP // The sender is the owner
+		c.Lock.Unlock()
+		c.recordTime(READ)
+		return nil
+	}
+
+	// This client is the owner now, so the copies handed over have to go before it can write
+	deadline := time.Now().Add(c.RequestTimeout)
+	c.Lock.Lock()
+	c.probOwner[msg.PageID] = c.IP
+	if f, ok := c.faults[msg.PageID]; ok {
+		deadline = f.expiry // Nobody waits for the page any longer than that
+	}
+	c.Lock.Unlock()
+	stale := c.invalidateCopies(msg.PageID, msg.CopySet, deadline)
+
+	c.Lock.Lock()
+	if len(stale) > 0 {
+		// Keep the copies that are left, the next write fault on the page tries them again
+		c.copySet[msg.PageID] = stale
+		c.Lock.Unlock()
+		return fmt.Errorf("%w at %s", ErrInvalidation, strings.Join(stale, ", "))
+	}
+	if page, ok := c.Cached[msg.PageID]; ok {
+		c.Cached[msg.PageID] = Page{ID: page.ID, Permission: WRITE, Data: page.Data}
+	}
+	c.Lock.Unlock()
+	c.recordTime(WRITE)
+	return nil
+}
+
+// Invalidates the copies of the page at the copyholders, trying the ones that fail again until deadline.
+// Returns the copyholders that still hold a copy.
+func (c *Client) invalidateCopies(pageID int, copies []string, deadline time.Time) []string {
+	for {
+		var failed []string
+		for _, ip := range copies {
+			_, err := c.call(ip, "Client.ReceiveRequest", message.Message{Type: INVALIDATE_CACHE, ID: c.ID, IP: c.IP, PageID: pageID})
+			if err != nil {
+				fmt.Printf("[NODE-%d] Error occurred while invalidating page %d at %s: %s\n", c.ID, pageID, ip, err)
+				failed = append(failed, ip)
+			}
+		}
+		if len(failed) == 0 || time.Now().Add(retryInterval).After(deadline) {
+			return failed
+		}
+		copies = failed
+		time.Sleep(retryInterval)
+	}
+}
+
+// Holds back a forwarded request while this client is itself waiting for the page.
+// Otherwise a writer that is about to receive ownership would bounce requests back along the chain.
+func (c *Client) waitForOwnFault(pageID int) {
+	c.Lock.Lock()
+	f, pending := c.faults[pageID]
+	c.Lock.Unlock()
+	if !pending {
+		return
+	}
+	select {
+	case <-f.done:
+	case <-time.After(c.RequestTimeout):
+	}
+}
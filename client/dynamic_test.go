@@ -0,0 +1,93 @@
+package client
+
+import (
+	"errors"
+	"ivy/config"
+	"ivy/utils"
+	"testing"
+	"time"
+)
+
+// Opens a client for each of the peers in dynamic mode, each dialing through its own transport
+func openPeers(t *testing.T, peers []string, transports []utils.Transport) []*Client {
+	t.Helper()
+	var clients []*Client
+	for i, ip := range peers {
+		c, err := Open(Config{IP: ip, Mode: config.DYNAMIC, Peers: peers, RequestTimeout: time.Second, Transport: transports[i]})
+		if err != nil {
+			t.Fatalf("opening the client on %s: %s", ip, err)
+		}
+		clients = append(clients, c)
+	}
+	return clients
+}
+
+func TestDynamicOwnershipMoves(t *testing.T) {
+	mem := utils.NewMemory()
+	peers := []string{"10.0.2.1:7000", "10.0.2.2:7000", "10.0.2.3:7000"}
+	clients := openPeers(t, peers, []utils.Transport{mem, mem, mem})
+
+	if err := clients[1].Write(0, []byte("A")); err != nil {
+		t.Fatalf("first write: %s", err)
+	}
+	data, err := clients[2].Read(0, 1)
+	if err != nil || string(data) != "A" {
+		t.Fatalf("read from the new owner: %q %v", data, err)
+	}
+	if err := clients[0].Write(0, []byte("B")); err != nil {
+		t.Fatalf("write by the default owner: %s", err)
+	}
+
+	// The last writer owns the page and the other copies are gone
+	for _, c := range clients[1:] {
+		c.Lock.Lock()
+		_, cached := c.Cached[0]
+		owner := c.probOwnerOf(0)
+		c.Lock.Unlock()
+		if cached {
+			t.Errorf("client %s still caches the page after it was written elsewhere", c.IP)
+		}
+		if owner != peers[0] {
+			t.Errorf("client %s thinks %s owns the page, want %s", c.IP, owner, peers[0])
+		}
+	}
+	data, err = clients[1].Read(0, 1)
+	if err != nil || string(data) != "B" {
+		t.Fatalf("read after the second write: %q %v", data, err)
+	}
+}
+
+func TestDynamicWriteWaitsForInvalidation(t *testing.T) {
+	mem := utils.NewMemory()
+	peers := []string{"10.0.2.1:7000", "10.0.2.2:7000", "10.0.2.3:7000"}
+	writer := utils.NewFaulty(mem)
+	clients := openPeers(t, peers, []utils.Transport{mem, mem, writer})
+
+	if err := clients[0].Write(0, []byte("A")); err != nil {
+		t.Fatalf("first write: %s", err)
+	}
+	if _, err := clients[1].Read(0, 1); err != nil {
+		t.Fatalf("read by the copyholder: %s", err)
+	}
+
+	// The copy cannot be invalidated, so the writer gets the page but may not write to it
+	writer.Cut(peers[1])
+	err := clients[2].Write(0, []byte("B"))
+	if !errors.Is(err, ErrInvalidation) {
+		t.Fatalf("write with a copyholder cut off: %v, want ErrInvalidation", err)
+	}
+	data, err := clients[1].Read(0, 1)
+	if err != nil || string(data) != "A" {
+		t.Fatalf("read by the copyholder: %q %v, want the copy it holds", data, err)
+	}
+
+	// Once the copyholder can be reached again the next write invalidates it first
+	writer.Heal(peers[1])
+	if err := clients[2].Write(0, []byte("B")); err != nil {
+		t.Fatalf("write after healing: %s", err)
+	}
+	data, err = clients[1].Read(0, 1)
+	if err != nil || string(data) != "B" {
+		t.Fatalf("read after the write: %q %v", data, err)
+	}
+}
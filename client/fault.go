@@ -0,0 +1,252 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"ivy/config"
+	"ivy/message"
+	"ivy/utils"
+	"strings"
+	"time"
+)
+
+var (
+	ErrTimeout      = errors.New("timed out waiting for the page")
+	ErrPageNotFound = errors.New(PAGE_NOT_FOUND)
+	ErrPageLost     = errors.New(PAGE_LOST)
+	ErrLeft         = errors.New("client has left the network")
+	ErrFailover     = errors.New("no central manager could be reached before the request gave up")
+	ErrEvicted      = errors.New("client was evicted from the network")
+	ErrInvalidation = errors.New("copies of the page could not be invalidated")
+)
+
+// FaultError is returned when a page fault could not be served.
+// Use errors.Is with ErrTimeout, ErrPageNotFound, ErrPageLost, ErrFailover, ErrEvicted, ErrInvalidation or ErrLeft to find out why.
+// ErrFailover means the central manager stayed unreachable until the fault expired, e.g. while failing over.
+// ErrInvalidation means a copyholder could not be reached in dynamic mode, so the page was kept read-only.
+type FaultError struct {
+	PageID     int
+	Permission string
+	Err        error
+}
+
+func (e *FaultError) Error() string {
+	return fmt.Sprintf("%s fault on page %d: %s", e.Permission, e.PageID, e.Err)
+}
+
+func (e *FaultError) Unwrap() error {
+	return e.Err
+}
+
+// Time between attempts at sending a request to a central manager that cannot be reached
+const retryInterval = 200 * time.Millisecond
+
+// An outstanding request for a page, shared by every caller waiting on that page
+type fault struct {
+	Permission  string
+	RequestID   string        // Sent with every attempt so that the central manager can tell retries apart from new requests
+	expiry      time.Time     // When the fault gives up
+	unreachable bool          // Set while the request is being retried because no central manager could be reached
+	done        chan struct{} // Closed once the fault is resolved
+	err         error         // Reason the fault failed, nil if the page arrived
+}
+
+// Blocks until the client holds the page with the given permission, requesting it from the central manager
+// (or the probable owner in dynamic mode) if needed.
+// Returns a *FaultError if the page does not arrive within RequestTimeout.
+func (c *Client) fault(pageID int, permission string) error {
+	expiry := time.Now().Add(c.RequestTimeout)
+	deadline := time.After(c.RequestTimeout)
+	for {
+		c.Lock.Lock()
+		if c.hasPermission(pageID, permission) {
+			c.Lock.Unlock()
+			return nil
+		}
+		if c.left {
+			err := ErrLeft
+			if c.evicted {
+				err = ErrEvicted
+			}
+			c.Lock.Unlock()
+			return &FaultError{PageID: pageID, Permission: permission, Err: err}
+		}
+		f, pending := c.faults[pageID]
+		if !pending {
+			c.requests++
+			f = &fault{Permission: permission, RequestID: fmt.Sprintf("%s/%d/%d", c.IP, c.opened.UnixNano(), c.requests), expiry: expiry, done: make(chan struct{})}
+			c.faults[pageID] = f
+		}
+		c.Lock.Unlock()
+
+		if !pending {
+			// The fault has to be in the table before the request goes out since the page can arrive before the call returns
+			if c.Mode == config.DYNAMIC {
+				// The call is given no longer than the fault itself
+				c.Lock.Lock()
+				owner := c.probOwnerOf(pageID)
+				c.Lock.Unlock()
+				ctx, cancel := context.WithTimeout(context.Background(), time.Until(expiry))
+				_, err := c.pool.Send(ctx, owner, "Client.ReceiveRequest", c.requestMessage(pageID, f))
+				cancel()
+				if err != nil {
+					c.resolveFault(pageID, f, faultErr(err))
+				}
+			} else {
+				c.request(pageID, f)
+			}
+		}
+
+		select {
+		case <-f.done:
+			if f.err != nil {
+				return &FaultError{PageID: pageID, Permission: permission, Err: f.err}
+			}
+			// The page arrived, loop around in case we joined a READ fault but need WRITE
+		case <-deadline:
+			err := ErrTimeout
+			c.Lock.Lock()
+			if f.unreachable {
+				err = ErrFailover
+			}
+			c.Lock.Unlock()
+			c.resolveFault(pageID, f, err)
+			return &FaultError{PageID: pageID, Permission: permission, Err: err}
+		}
+	}
+}
+
+// Sends the request for the page to its central manager until one of them takes it, the fault is resolved or it expires.
+// A central manager that cannot be reached, that has stepped down or that is a raft replica other than the leader may be failing over,
+// so the request is sent again to whichever one the client has been told about since. The request id stays the same, so a central manager that did get
+// the earlier attempt does not queue the request twice.
+func (c *Client) request(pageID int, f *fault) {
+	for {
+		c.Lock.Lock()
+		if c.faults[pageID] != f || c.hasPermission(pageID, f.Permission) {
+			c.Lock.Unlock()
+			return // Resolved while the earlier attempt was going out
+		}
+		target := c.managerOf(pageID)
+		c.Lock.Unlock()
+
+		ctx, cancel := context.WithDeadline(context.Background(), f.expiry)
+		_, err := c.pool.Send(ctx, target, "CentralManager.ReceiveRequest", c.requestMessage(pageID, f))
+		cancel()
+		if err == nil {
+			c.setUnreachable(f, false)
+			return
+		}
+		if !retryable(err) || utils.IsTimeout(err) {
+			c.resolveFault(pageID, f, faultErr(err))
+			return
+		}
+		if time.Now().Add(retryInterval).After(f.expiry) {
+			c.resolveFault(pageID, f, ErrFailover) // The central manager never came back in time
+			return
+		}
+		c.setUnreachable(f, true)
+		c.followLeader(err)
+		fmt.Printf("[NODE-%d] Retrying request %s for page %d: %s\n", c.ID, f.RequestID, pageID, err)
+		time.Sleep(retryInterval)
+	}
+}
+
+// Records whether the last attempt at sending the request of the fault found no central manager
+func (c *Client) setUnreachable(f *fault, unreachable bool) {
+	c.Lock.Lock()
+	defer c.Lock.Unlock()
+	f.unreachable = unreachable
+}
+
+// Builds the message asking for the page with the permission of the fault
+func (c *Client) requestMessage(pageID int, f *fault) message.Message {
+	return message.Message{Type: f.Permission, ID: c.ID, IP: c.IP, PageID: pageID, RequestID: f.RequestID, Epoch: c.currentEpoch()}
+}
+
+// Checks if the central manager refused the request because it has been replaced or has lost its lease,
+// in which case it is sent again like to a central manager that cannot be reached
+func fenced(err error) bool {
+	return err != nil && strings.Contains(err.Error(), STALE_EPOCH)
+}
+
+// Checks if a call to a central manager may go through when sent again, possibly to the one the client is told about next
+func retryable(err error) bool {
+	return utils.IsUnreachable(err) || fenced(err) || strings.Contains(err.Error(), NOT_LEADER)
+}
+
+// Points the client at the raft leader named by a replica that refused a call for not being the leader.
+// The leader also tells every client once it is elected, this only saves waiting for it.
+func (c *Client) followLeader(err error) {
+	_, leader, found := strings.Cut(err.Error(), NOT_LEADER+", the leader is ")
+	if !found || c.Mode == config.FIXED {
+		return
+	}
+	c.Lock.Lock()
+	c.ServerIP = strings.TrimSpace(leader)
+	c.Lock.Unlock()
+}
+
+// Maps the error of a failed request to the reason the fault failed
+func faultErr(err error) error {
+	if strings.Contains(err.Error(), PAGE_NOT_FOUND) {
+		return ErrPageNotFound
+	} else if strings.Contains(err.Error(), PAGE_LOST) {
+		return ErrPageLost
+	} else if utils.IsTimeout(err) {
+		return ErrTimeout
+	}
+	return err
+}
+
+// Waits for the pending faults to be resolved, at most RequestTimeout since that is when they give up
+func (c *Client) waitForFaults() {
+	deadline := time.Now().Add(c.RequestTimeout)
+	for time.Now().Before(deadline) {
+		c.Lock.Lock()
+		pending := len(c.faults)
+		c.Lock.Unlock()
+		if pending == 0 {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// Checks if the cached page grants the permission, must be called with the lock held
+func (c *Client) hasPermission(pageID int, permission string) bool {
+	page, ok := c.Cached[pageID]
+	return ok && (permission == READ || page.Permission == WRITE)
+}
+
+// Removes the fault from the table and wakes up its waiters with err
+func (c *Client) resolveFault(pageID int, f *fault, err error) {
+	c.Lock.Lock()
+	defer c.Lock.Unlock()
+	if c.faults[pageID] != f {
+		return // Already resolved
+	}
+	delete(c.faults, pageID)
+	f.err = err
+	close(f.done)
+}
+
+// Resolves whatever fault is pending on the page
+func (c *Client) completeFault(pageID int, err error) {
+	c.Lock.Lock()
+	f, ok := c.faults[pageID]
+	c.Lock.Unlock()
+	if ok {
+		c.resolveFault(pageID, f, err)
+	}
+}
+
+// Sends every pending request again, used when the central manager changes since the new one may never have seen them
+func (c *Client) retryFaults() {
+	c.Lock.Lock()
+	defer c.Lock.Unlock()
+	for pageID, f := range c.faults {
+		go c.request(pageID, f)
+	}
+}
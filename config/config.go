@@ -0,0 +1,255 @@
+package config
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"time"
+)
+
+const (
+	LOCALHOST   = "127.0.0.1:"
+	PRIMARYIP   = LOCALHOST + "8000"
+	BACKUPIP    = LOCALHOST + "8001"
+	NUM_PAGES   = 4    // Number of pages in the system
+	PAGE_SIZE   = 1024 // Size of each page in bytes
+	NUMREQUESTS = 10
+	CENTRAL     = "central" // Every page fault goes through the central manager
+	DYNAMIC     = "dynamic" // Dynamic distributed manager, page faults follow the probable owners
+	FIXED       = "fixed"   // Fixed distributed manager, each page is managed by Managers[page % len(Managers)]
+)
+
+// Config holds the settings shared by the central managers and the clients.
+// Values come from the defaults, then the JSON config file, then the command-line flags.
+type Config struct {
+	Mode                string   `json:"mode"`                  // Manager mode, CENTRAL, DYNAMIC or FIXED
+	Listen              string   `json:"listen"`                // Address this node listens on, defaults to the role's own address
+	Peers               List     `json:"peers"`                 // Addresses of every client in DYNAMIC mode, the first one initially owns all pages
+	Managers            List     `json:"managers"`              // Addresses of the central managers sharing the pages in FIXED mode
+	Primary             string   `json:"primary"`               // Address of the primary central manager
+	Backup              string   `json:"backup"`                // Address of the backup central manager
+	Backups             List     `json:"backups"`               // Addresses of the backup central managers in order of succession, replaces backup when set
+	Clients             List     `json:"clients"`               // Addresses of the clients a recovering central manager asks for their pages, on top of the members it knows
+	Replicas            List     `json:"replicas"`              // Addresses of the raft replicas of the central manager, replaces primary and backup when set
+	NumPages            int      `json:"num_pages"`             // Number of pages in the shared memory
+	PageSize            int      `json:"page_size"`             // Size of each page in bytes
+	BackupInterval      Duration `json:"backup_interval"`       // Time between attempts to resync a backup that has fallen behind the primary
+	HealthCheckInterval Duration `json:"health_check_interval"` // Time between checks of the primary's lease by the backup
+	LeaseDuration       Duration `json:"lease_duration"`        // How long a lease renewal from the primary lasts, it is renewed three times per lease
+	SuspicionThreshold  int      `json:"suspicion_threshold"`   // Health checks in a row that must find the lease expired before the backup takes over
+	RequestTimeout      Duration `json:"request_timeout"`       // How long a client page fault waits for its page
+	InvalidateTimeout   Duration `json:"invalidate_timeout"`    // How long a WRITE waits for the copies to confirm their invalidation
+	RPCTimeout          Duration `json:"rpc_timeout"`           // Deadline of the RPC calls that have none in rpc_timeouts
+	RPCTimeouts         Timeouts `json:"rpc_timeouts"`          // Deadlines of the RPC calls by message type, or by method name for the calls between central managers
+	ElectionTimeout     Duration `json:"election_timeout"`      // How long a raft replica waits to hear from the leader before starting an election
+	HeartbeatInterval   Duration `json:"heartbeat_interval"`    // Time between heartbeats from the raft leader
+	DataDir             string   `json:"data_dir"`              // Directory where central managers keep their write-ahead log and snapshots, or their raft log, nothing is persisted when empty
+	SnapshotInterval    Duration `json:"snapshot_interval"`     // Time between snapshots of the central manager metadata
+	ReplicatePages      bool     `json:"replicate_pages"`       // Clients push every written page to the central manager, which serves it if the owner dies
+	ClientHeartbeat     Duration `json:"client_heartbeat"`      // Time between heartbeats from the clients to the central manager
+	ClientTimeout       Duration `json:"client_timeout"`        // How long the central manager goes without a heartbeat before it considers a client dead
+	TLSCert             string   `json:"tls_cert"`              // Certificate this node presents to the others, the nodes talk over mutual TLS when set
+	TLSKey              string   `json:"tls_key"`               // Private key of the certificate
+	TLSCA               string   `json:"tls_ca"`                // Certificate authority that signs the certificates of every node
+	Workload            Workload `json:"workload"`
+}
+
+// Workload describes the random read/write requests a client makes when the central manager starts them
+type Workload struct {
+	NumRequests     int      `json:"num_requests"`     // Number of requests made by each client
+	RequestInterval Duration `json:"request_interval"` // Time between two requests
+	ReadPercentage  int      `json:"read_percentage"`  // Percentage of requests that are READs, the rest are WRITEs
+}
+
+// Returns the configuration used when nothing else is given
+func Default() Config {
+	return Config{
+		Mode:                CENTRAL,
+		Primary:             PRIMARYIP,
+		Backup:              BACKUPIP,
+		NumPages:            NUM_PAGES,
+		PageSize:            PAGE_SIZE,
+		BackupInterval:      Duration(1 * time.Second),
+		HealthCheckInterval: Duration(1 * time.Second),
+		LeaseDuration:       Duration(3 * time.Second),
+		SuspicionThreshold:  3,
+		RequestTimeout:      Duration(5 * time.Second),
+		InvalidateTimeout:   Duration(4 * time.Second), // At least the deadline of INVALIDATE_CACHE
+		RPCTimeout:          Duration(2 * time.Second),
+		ElectionTimeout:     Duration(1 * time.Second),
+		HeartbeatInterval:   Duration(200 * time.Millisecond),
+		SnapshotInterval:    Duration(30 * time.Second),
+		ClientHeartbeat:     Duration(1 * time.Second),
+		ClientTimeout:       Duration(3 * time.Second),
+		RPCTimeouts: Timeouts{
+			// A call has to outlast the calls its handler makes in turn, so the ones further up the chain get longer
+			"RECEIVE_PAGE":          Duration(4 * time.Second), // The receiver confirms with the central manager
+			"INVALIDATE_CACHE":      Duration(4 * time.Second), // The copyholder confirms with the central manager
+			"READ_FORWARD":          Duration(6 * time.Second), // The owner sends RECEIVE_PAGE
+			"WRITE_FORWARD":         Duration(6 * time.Second),
+			"READ":                  Duration(8 * time.Second), // The central manager sends READ_FORWARD
+			"WRITE":                 Duration(8 * time.Second),
+			"CentralManager.Backup": Duration(5 * time.Second), // Carries the whole metadata
+		},
+		Workload: Workload{
+			NumRequests:     NUMREQUESTS,
+			RequestInterval: Duration(10 * time.Second),
+			ReadPercentage:  10, // write-intensive workload
+		},
+	}
+}
+
+// Binds the command-line flags to the fields of cfg
+func (cfg *Config) RegisterFlags(fs *flag.FlagSet) {
+	fs.StringVar(&cfg.Mode, "mode", cfg.Mode, "manager mode, central, dynamic or fixed")
+	fs.StringVar(&cfg.Listen, "listen", cfg.Listen, "address this node listens on")
+	fs.Var(&cfg.Peers, "peers", "comma separated addresses of every client in dynamic mode")
+	fs.Var(&cfg.Managers, "managers", "comma separated addresses of the central managers in fixed mode")
+	fs.StringVar(&cfg.Primary, "primary", cfg.Primary, "address of the primary central manager")
+	fs.StringVar(&cfg.Backup, "backup", cfg.Backup, "address of the backup central manager")
+	fs.Var(&cfg.Backups, "backups", "comma separated addresses of the backup central managers in order of succession")
+	fs.Var(&cfg.Clients, "clients", "comma separated addresses of the clients to recover the metadata from")
+	fs.Var(&cfg.Replicas, "replicas", "comma separated addresses of the raft replicas of the central manager")
+	fs.IntVar(&cfg.NumPages, "pages", cfg.NumPages, "number of pages in the shared memory")
+	fs.IntVar(&cfg.PageSize, "page-size", cfg.PageSize, "size of each page in bytes")
+	fs.Var(&cfg.BackupInterval, "backup-interval", "time between attempts to resync a backup that has fallen behind")
+	fs.Var(&cfg.HealthCheckInterval, "health-check-interval", "time between checks of the primary's lease")
+	fs.Var(&cfg.LeaseDuration, "lease-duration", "how long a lease renewal from the primary lasts")
+	fs.IntVar(&cfg.SuspicionThreshold, "suspicion-threshold", cfg.SuspicionThreshold, "health checks in a row that must find the lease expired before the backup takes over")
+	fs.Var(&cfg.RequestTimeout, "request-timeout", "how long a page fault waits for its page")
+	fs.Var(&cfg.InvalidateTimeout, "invalidate-timeout", "how long a write waits for the copies to confirm their invalidation")
+	fs.Var(&cfg.RPCTimeout, "rpc-timeout", "deadline of the RPC calls without one of their own in rpc_timeouts")
+	fs.Var(&cfg.ElectionTimeout, "election-timeout", "how long a raft replica waits for the leader before starting an election")
+	fs.Var(&cfg.HeartbeatInterval, "heartbeat-interval", "time between heartbeats from the raft leader")
+	fs.StringVar(&cfg.DataDir, "data-dir", cfg.DataDir, "directory where central managers persist their metadata")
+	fs.Var(&cfg.SnapshotInterval, "snapshot-interval", "time between snapshots of the central manager metadata")
+	fs.Var(&cfg.ClientHeartbeat, "client-heartbeat", "time between heartbeats from the clients to the central manager")
+	fs.Var(&cfg.ClientTimeout, "client-timeout", "how long a client may go without a heartbeat before it is considered dead")
+	fs.StringVar(&cfg.TLSCert, "tls-cert", cfg.TLSCert, "certificate this node presents to the others over mutual TLS")
+	fs.StringVar(&cfg.TLSKey, "tls-key", cfg.TLSKey, "private key of the TLS certificate")
+	fs.StringVar(&cfg.TLSCA, "tls-ca", cfg.TLSCA, "certificate authority that signs the certificates of every node")
+	fs.BoolVar(&cfg.ReplicatePages, "replicate-pages", cfg.ReplicatePages, "push every written page to the central manager so that it survives its owner")
+	fs.IntVar(&cfg.Workload.NumRequests, "requests", cfg.Workload.NumRequests, "number of requests made by each client")
+	fs.Var(&cfg.Workload.RequestInterval, "request-interval", "time between two client requests")
+	fs.IntVar(&cfg.Workload.ReadPercentage, "read-percentage", cfg.Workload.ReadPercentage, "percentage of client requests that are READs")
+}
+
+// Parses args into a Config. The file named by -config is applied on top of the defaults and
+// any flag given explicitly is applied on top of the file.
+func Parse(fs *flag.FlagSet, args []string) (Config, error) {
+	cfg := Default()
+	path := fs.String("config", "", "path to a JSON config file")
+	cfg.RegisterFlags(fs)
+	if err := fs.Parse(args); err != nil {
+		return Config{}, err
+	}
+	if *path == "" {
+		return cfg, cfg.Validate()
+	}
+
+	fileCfg := Default()
+	if err := LoadFile(*path, &fileCfg); err != nil {
+		return Config{}, err
+	}
+
+	// Re-apply the flags that were set explicitly so they win over the file
+	overrides := flag.NewFlagSet(fs.Name(), flag.ContinueOnError)
+	fileCfg.RegisterFlags(overrides)
+	var err error
+	fs.Visit(func(f *flag.Flag) {
+		if overrides.Lookup(f.Name) != nil && err == nil {
+			err = overrides.Set(f.Name, f.Value.String())
+		}
+	})
+	if err != nil {
+		return Config{}, err
+	}
+	return fileCfg, fileCfg.Validate()
+}
+
+// Reads the JSON config file at path into cfg, leaving fields missing from the file untouched
+func LoadFile(path string, cfg *Config) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("error reading config file %s: %s", path, err)
+	}
+	if err := json.Unmarshal(data, cfg); err != nil {
+		return fmt.Errorf("error parsing config file %s: %s", path, err)
+	}
+	return nil
+}
+
+// Returns the backup central managers in order of succession
+func (cfg Config) Standbys() []string {
+	if len(cfg.Backups) > 0 {
+		return cfg.Backups
+	}
+	return []string{cfg.Backup}
+}
+
+// Whether the nodes talk over mutual TLS
+func (cfg Config) TLS() bool {
+	return cfg.TLSCert != ""
+}
+
+// Checks that the configuration makes sense
+func (cfg Config) Validate() error {
+	switch cfg.Mode {
+	case CENTRAL:
+		if len(cfg.Replicas) > 0 && (cfg.ElectionTimeout <= 0 || cfg.HeartbeatInterval <= 0 || cfg.HeartbeatInterval >= cfg.ElectionTimeout) {
+			return fmt.Errorf("raft replication needs a positive heartbeat interval shorter than the election timeout")
+		}
+	case DYNAMIC:
+		if len(cfg.Peers) == 0 {
+			return fmt.Errorf("dynamic mode needs the addresses of the clients in peers")
+		}
+	case FIXED:
+		if len(cfg.Managers) == 0 {
+			return fmt.Errorf("fixed mode needs the addresses of the central managers in managers")
+		}
+		if len(cfg.Replicas) > 0 {
+			return fmt.Errorf("raft replicas are only supported in central mode")
+		}
+	default:
+		return fmt.Errorf("unknown mode %q, expected %s, %s or %s", cfg.Mode, CENTRAL, DYNAMIC, FIXED)
+	}
+	if cfg.DataDir != "" && cfg.SnapshotInterval <= 0 {
+		return fmt.Errorf("snapshot interval must be positive, got %s", cfg.SnapshotInterval)
+	}
+	if cfg.ClientHeartbeat <= 0 || cfg.ClientTimeout <= cfg.ClientHeartbeat {
+		return fmt.Errorf("client heartbeat must be positive and shorter than the client timeout")
+	}
+	if (cfg.TLSCert != "") != (cfg.TLSKey != "") || (cfg.TLSCert != "") != (cfg.TLSCA != "") {
+		return fmt.Errorf("mutual TLS needs the certificate, its key and the certificate authority")
+	}
+	if cfg.RPCTimeout <= 0 {
+		return fmt.Errorf("rpc timeout must be positive, got %s", cfg.RPCTimeout)
+	}
+	for key, timeout := range cfg.RPCTimeouts {
+		if timeout <= 0 {
+			return fmt.Errorf("rpc timeout for %s must be positive, got %s", key, timeout)
+		}
+	}
+	invalidate := cfg.RPCTimeout
+	if timeout, ok := cfg.RPCTimeouts["INVALIDATE_CACHE"]; ok {
+		invalidate = timeout
+	}
+	if cfg.InvalidateTimeout < invalidate {
+		// The copyholders left over are evicted when it runs out, so a copyholder still within its deadline could keep a stale copy
+		return fmt.Errorf("invalidate timeout (%s) must be at least the INVALIDATE_CACHE rpc timeout (%s)", cfg.InvalidateTimeout, invalidate)
+	}
+	if cfg.LeaseDuration <= 0 || cfg.SuspicionThreshold <= 0 {
+		return fmt.Errorf("lease duration and suspicion threshold must be positive")
+	}
+	if cfg.NumPages <= 0 {
+		return fmt.Errorf("number of pages must be positive, got %d", cfg.NumPages)
+	}
+	if cfg.PageSize <= 0 {
+		return fmt.Errorf("page size must be positive, got %d", cfg.PageSize)
+	}
+	if cfg.Workload.ReadPercentage < 0 || cfg.Workload.ReadPercentage > 100 {
+		return fmt.Errorf("read percentage must be between 0 and 100, got %d", cfg.Workload.ReadPercentage)
+	}
+	return nil
+}
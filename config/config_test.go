@@ -0,0 +1,94 @@
+package config
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Writes the JSON config file and returns its path
+func writeConfig(t *testing.T, data string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.json")
+	if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func parse(t *testing.T, args ...string) Config {
+	t.Helper()
+	cfg, err := Parse(flag.NewFlagSet("ivy", flag.ContinueOnError), args)
+	if err != nil {
+		t.Fatalf("Parse(%v): %s", args, err)
+	}
+	return cfg
+}
+
+func TestParseDefaults(t *testing.T) {
+	cfg := parse(t)
+	if cfg.Mode != CENTRAL || cfg.Primary != PRIMARYIP || cfg.NumPages != NUM_PAGES {
+		t.Fatalf("got %s %s %d, want the defaults", cfg.Mode, cfg.Primary, cfg.NumPages)
+	}
+}
+
+func TestParseFileOverridesDefaults(t *testing.T) {
+	path := writeConfig(t, `{"num_pages": 8, "lease_duration": "5s", "backups": ["127.0.0.1:9001", "127.0.0.1:9002"]}`)
+	cfg := parse(t, "-config", path)
+	if cfg.NumPages != 8 {
+		t.Errorf("num_pages = %d, want 8 from the file", cfg.NumPages)
+	}
+	if time.Duration(cfg.LeaseDuration) != 5*time.Second {
+		t.Errorf("lease_duration = %s, want 5s from the file", cfg.LeaseDuration)
+	}
+	if len(cfg.Backups) != 2 || cfg.Standbys()[1] != "127.0.0.1:9002" {
+		t.Errorf("backups = %v, want the two from the file", cfg.Backups)
+	}
+	if cfg.PageSize != PAGE_SIZE {
+		t.Errorf("page_size = %d, want the default since the file leaves it out", cfg.PageSize)
+	}
+}
+
+func TestParseFlagsOverrideFile(t *testing.T) {
+	path := writeConfig(t, `{"num_pages": 8, "page_size": 256, "mode": "central"}`)
+	for _, args := range [][]string{
+		{"-config", path, "-pages", "16"},
+		{"-pages", "16", "-config", path}, // The order of the flags does not matter
+	} {
+		cfg := parse(t, args...)
+		if cfg.NumPages != 16 {
+			t.Errorf("%v: pages = %d, want 16 from the flag", args, cfg.NumPages)
+		}
+		if cfg.PageSize != 256 {
+			t.Errorf("%v: page_size = %d, want 256 from the file", args, cfg.PageSize)
+		}
+	}
+
+	// A flag given explicitly wins even when it is set to the default
+	cfg := parse(t, "-config", path, "-pages", "4")
+	if cfg.NumPages != NUM_PAGES {
+		t.Errorf("pages = %d, want %d from the flag", cfg.NumPages, NUM_PAGES)
+	}
+}
+
+func TestParseRejectsInvalid(t *testing.T) {
+	for _, args := range [][]string{
+		{"-mode", "unknown"},
+		{"-pages", "0"},
+		{"-page-size", "-1"},
+		{"-read-percentage", "101"},
+		{"-mode", "dynamic"}, // Without the peers
+		{"-replicas", "127.0.0.1:8100,127.0.0.1:8101", "-heartbeat-interval", "2s", "-election-timeout", "1s"},
+	} {
+		if _, err := Parse(flag.NewFlagSet("ivy", flag.ContinueOnError), args); err == nil {
+			t.Errorf("Parse(%v) succeeded, want an error", args)
+		}
+	}
+
+	path := writeConfig(t, `{"num_pages": "eight"}`)
+	if _, err := Parse(flag.NewFlagSet("ivy", flag.ContinueOnError), []string{"-config", path}); err == nil {
+		t.Errorf("Parse with a malformed file succeeded, want an error")
+	}
+}
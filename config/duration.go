@@ -0,0 +1,48 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// Duration is a time.Duration written as "1s" or "500ms" in config files and flags
+type Duration time.Duration
+
+func (d Duration) String() string {
+	return time.Duration(d).String()
+}
+
+// Implements flag.Value
+func (d *Duration) Set(s string) error {
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("duration must be a string such as \"5s\": %s", err)
+	}
+	return d.Set(s)
+}
+
+// Timeouts maps message types or method names to a Duration
+type Timeouts map[string]Duration
+
+// Returns the timeouts as time.Duration values
+func (t Timeouts) Durations() map[string]time.Duration {
+	durations := make(map[string]time.Duration, len(t))
+	for key, timeout := range t {
+		durations[key] = time.Duration(timeout)
+	}
+	return durations
+}
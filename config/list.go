@@ -0,0 +1,21 @@
+package config
+
+import "strings"
+
+// List is a list of addresses written as "a,b,c" on the command line and as a JSON array in config files
+type List []string
+
+func (l List) String() string {
+	return strings.Join(l, ",")
+}
+
+// Implements flag.Value
+func (l *List) Set(s string) error {
+	*l = nil
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			*l = append(*l, item)
+		}
+	}
+	return nil
+}
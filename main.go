@@ -1,10 +1,10 @@
 package main
 
 import (
-	"encoding/json"
+	"flag"
 	"fmt"
-	"io/ioutil"
 	"ivy/CM"
+	"ivy/config"
 	"ivy/client"
 	"ivy/message"
 	"ivy/utils"
@@ -15,34 +15,109 @@ import (
 )
 
 func main() {
+	fs := flag.NewFlagSet(os.Args[0], flag.ExitOnError)
+	isCM := fs.Bool("cm", false, "run the primary central manager")
+	isBackup := fs.Bool("b", false, "run the backup central manager")
+	isClient := fs.Bool("cl", false, "run a client")
+	isRecovering := fs.Bool("recover", false, "rebuild the central manager metadata from the pages cached by the clients")
+	fs.Usage = func() {
+		fmt.Println("Usage: go run main.go -cm OR go run main.go -cl OR go run main.go -b [-config file.json] [flags]")
+		fs.PrintDefaults()
+	}
 
-	args := os.Args
+	cfg, err := config.Parse(fs, os.Args[1:])
+	if err != nil {
+		fmt.Println("Error occurred while reading the configuration: ", err)
+		return
+	}
+	utils.DefaultPool.SetTimeouts(time.Duration(cfg.RPCTimeout), cfg.RPCTimeouts.Durations())
+	var transport utils.Transport = utils.TCP{}
+	if cfg.TLS() {
+		transport, err = utils.LoadTLS(utils.TCP{}, cfg.TLSCert, cfg.TLSKey, cfg.TLSCA)
+		if err != nil {
+			fmt.Println("Error occurred while loading the TLS certificates: ", err)
+			return
+		}
+		utils.DefaultPool = utils.DefaultPool.WithTransport(transport) // For the calls made from here
+	}
 
-	if len(args) < 2 {
-		fmt.Println("Usage: go run main.go -cm or go run main.go -cl or go run main.go -b")
+	role := ""
+	switch {
+	case *isCM:
+		role = "-cm"
+	case *isBackup:
+		role = "-b"
+	case *isClient:
+		role = "-cl"
+	}
+
+	if cfg.Mode == config.DYNAMIC && role != "-cl" {
+		fmt.Println("There is no central manager in dynamic mode, only clients (-cl) can be started.")
+		return
+	}
+	if cfg.Mode == config.FIXED && role == "-b" {
+		fmt.Println("There is no backup central manager in fixed mode.")
+		return
+	}
+	if cfg.Mode == config.FIXED && *isRecovering {
+		fmt.Println("Recovering from the clients is not supported in fixed mode, every central manager has its own epoch but the clients only track one.")
+		return
+	}
+	if len(cfg.Replicas) > 0 && role == "-b" {
+		fmt.Println("There is no backup central manager with raft replicas, start every replica with -cm -listen <replica>.")
 		return
 	}
 
-	switch args[1] {
+	switch role {
 		case "-cm":
 			// Start the central manager
-			cm := CM.CentralManager{
-				IP: client.CENTRALIP,
-				Records: make(map[int]CM.Record),
+			ip := cfg.Primary
+			if cfg.Mode == config.FIXED {
+				ip = cfg.Managers[0]
+			}
+			cm := CM.NewCentralManager(ip, cfg)
+			cm.UseTransport(transport)
+			if cm.Shard == -1 {
+				fmt.Printf("%s is not one of the central managers %v\n", cm.IP, cfg.Managers)
+				return
+			}
+			if len(cfg.Replicas) > 0 && !cm.IsReplica() {
+				fmt.Printf("%s is not one of the raft replicas %v\n", cm.IP, cfg.Replicas)
+				return
+			}
+			if err := cm.Restore(); err != nil {
+				fmt.Println("Error occurred while restoring the metadata: ", err)
+				return
+			}
+			if cfg.DataDir != "" && !cm.IsReplica() {
+				go cm.StartSnapshots() // Raft replicas keep their whole log instead
 			}
 
 			// Start the RPC server
 			go cm.StartRPCServer()
+			if *isRecovering {
+				if err := cm.Recover(cfg.Clients); err != nil {
+					fmt.Println("Error occurred while recovering the metadata from the clients: ", err)
+					return
+				}
+			}
+			if cm.IsReplica() {
+				go cm.StartRaft() // Leader election replaces the backup and its health checks
+			} else if cfg.Mode != config.FIXED {
+				go cm.HoldLease() // Keeps the backup from taking over while the start prompt is waiting
+			}
 
-			for {
+			for cm.Shard == 0 { // In fixed mode only the first central manager knows the members
 				var answer string
 				fmt.Println("Make sure you have all the clients running before starting the read and write requests.")
 				fmt.Println("Do you want to start the read and write requests from the clients? (y/n)")
 				fmt.Scanln(&answer)
 	
 				if answer == "y" {
-					nodesList := utils.ReadNodesList()
-					for _, ip := range nodesList {
+					cm.Lock.Lock()
+					members := cm.Clients()
+					cm.Lock.Unlock()
+					for _, ip := range members {
 						go func() {
 							_, err := utils.CallByRPC(ip, "Client.RequestPage", message.Message{})
 							if err != nil {
@@ -56,7 +131,9 @@ func main() {
 				}
 			}
 
-			go cm.StartBackup() // Comment this to make this into a basic Ivy implementation
+			if cfg.Mode != config.FIXED && !cm.IsReplica() {
+				go cm.StartBackup() // Comment this to make this into a basic Ivy implementation
+			}
 
 			for {
 				utils.ShowMenu()
@@ -70,11 +147,18 @@ func main() {
 						fmt.Printf("PageID: %d, Owner: %d and Copies: %v\n", key, val.Owner.ID, val.Copies)
 					}
 				case 2:
-					// Display the write queue
-					fmt.Printf("Write Queue:\n")
-					for _, val := range cm.WriteQueue {
-						fmt.Printf("PageID: %d and Owner: %d\n", val.PageID, val.From.ID)
+					// Display the page queues
+					fmt.Printf("Page Queues:\n")
+					cm.Lock.Lock()
+					for pageID, queue := range cm.Queues {
+						for _, val := range queue {
+							fmt.Printf("PageID: %d, Type: %s and From: %d\n", pageID, val.Type, val.From.ID)
+						}
+					}
+					for pageID, transition := range cm.Transitions {
+						fmt.Printf("PageID: %d, Writing: %t and Readers in flight: %d\n", pageID, transition.Writing, transition.Readers)
 					}
+					cm.Lock.Unlock()
 				case 3:
 					// Kill the current node
 					fmt.Printf("Killing the current node...\n")
@@ -82,10 +166,24 @@ func main() {
 				case 4: 
 					// Reboot the current node
 					fmt.Printf("Rebooting the current node...\n")
-					cm.IsRebooting = true
-					time.Sleep(12 * time.Second)
-					cm.IsRebooting = false
+					if err := cm.Reboot(12 * time.Second); err != nil {
+						fmt.Println("Error occurred while restoring the metadata: ", err)
+					}
 					fmt.Printf("Node has been rebooted.\n")
+				case 5:
+					// Display the members
+					fmt.Printf("Members:\n")
+					cm.Lock.Lock()
+					for id, ip := range cm.Members {
+						fmt.Printf("ClientID: %d and IP: %s\n", id, ip)
+					}
+					cm.Lock.Unlock()
+				case 6:
+					// Display the raft replication state
+					fmt.Println(cm.RaftStatus())
+				case 7:
+					// Display when every client was last heard from
+					fmt.Print(cm.Liveness())
 				default:
 					fmt.Printf("Invalid choice: %d\n", choice)
 				}
@@ -94,13 +192,24 @@ func main() {
 		case "-b":
 			// Start the backup central manager
 
-			cm := CM.CentralManager{
-				IP: client.BACKUPIP,
-				Records: make(map[int]CM.Record),
+			cm := CM.NewCentralManager(cfg.Standbys()[0], cfg)
+			cm.UseTransport(transport)
+			if cm.Rank <= 0 {
+				fmt.Printf("%s is not one of the backup central managers %v\n", cm.IP, cfg.Standbys())
+				return
+			}
+			if err := cm.Restore(); err != nil {
+				fmt.Println("Error occurred while restoring the metadata: ", err)
+				return
+			}
+			if cfg.DataDir != "" {
+				go cm.StartSnapshots()
 			}
 
 			go cm.StartRPCServer()
-			go cm.HealthCheck() // Health check for the primary central manager
+			go cm.HealthCheck() // Health check for the central managers ahead of this one
+			go cm.HoldLease() // Both only do anything once this backup has taken over
+			go cm.StartBackup()
 
 			for {
 				utils.ShowMenu()
@@ -114,11 +223,18 @@ func main() {
 						fmt.Printf("PageID: %d, Owner: %d and Copies: %v\n", key, val.Owner.ID, val.Copies)
 					}
 				case 2:
-					// Display the write queue
-					fmt.Printf("Write Queue:\n")
-					for _, val := range cm.WriteQueue {
-						fmt.Printf("PageID: %d and Owner: %d\n", val.PageID, val.From.ID)
+					// Display the page queues
+					fmt.Printf("Page Queues:\n")
+					cm.Lock.Lock()
+					for pageID, queue := range cm.Queues {
+						for _, val := range queue {
+							fmt.Printf("PageID: %d, Type: %s and From: %d\n", pageID, val.Type, val.From.ID)
+						}
+					}
+					for pageID, transition := range cm.Transitions {
+						fmt.Printf("PageID: %d, Writing: %t and Readers in flight: %d\n", pageID, transition.Writing, transition.Readers)
 					}
+					cm.Lock.Unlock()
 				case 3:
 					// Kill the current node
 					fmt.Printf("Killing the current node...\n")
@@ -126,38 +242,62 @@ func main() {
 				case 4: 
 					// Reboot the current node
 					fmt.Printf("Rebooting the current node...\n")
-					cm.IsRebooting = true
-					time.Sleep(10 * time.Second)
-					cm.IsRebooting = false
+					if err := cm.Reboot(10 * time.Second); err != nil {
+						fmt.Println("Error occurred while restoring the metadata: ", err)
+					}
 					fmt.Printf("Node has been rebooted.\n")
+				case 5:
+					// Display the members
+					fmt.Printf("Members:\n")
+					cm.Lock.Lock()
+					for id, ip := range cm.Members {
+						fmt.Printf("ClientID: %d and IP: %s\n", id, ip)
+					}
+					cm.Lock.Unlock()
+				case 6:
+					// Display the raft replication state
+					fmt.Println(cm.RaftStatus())
+				case 7:
+					// Display when every client was last heard from
+					fmt.Print(cm.Liveness())
 				default:
 					fmt.Printf("Invalid choice: %d\n", choice)
 				}
 			}
 		case "-cl":
 			// Start the client
-			nodesList := utils.ReadNodesList()
-			client := client.Client{
-				ID: len(nodesList),
-				IP: client.LOCALHOST + fmt.Sprint(8002+len(nodesList)),
-				Cached: make(map[int]client.Page),
-				ServerIP: client.CENTRALIP, // assigning the primary central manager IP first
-				StartTime: time.Now(),
-			}
-			
-			nodesList[client.ID] = client.IP
-
-			jsonData, err := json.Marshal(nodesList)
+			ccfg := client.NewConfig(cfg)
+			ccfg.Transport = transport
+			client, err := client.Open(ccfg)
 			if err != nil {
-				fmt.Println("Error occurred while marshalling the Ring into nodes-list.json: ", err)
-			}
-			
-			err = ioutil.WriteFile("nodes-list.json", jsonData, os.ModePerm)
-			if err != nil {
-				fmt.Println("Error occurred while marshalling the Ring back into nodes-list.json: ", err)
+				fmt.Println("Error occurred while starting the client: ", err)
+				return
 			}
 
-			go client.StartRPCServer()
+			if cfg.Mode == config.DYNAMIC && client.ID == 0 {
+				// Without a central manager the first peer starts the read and write requests
+				go func() {
+					for {
+						var answer string
+						fmt.Println("Make sure you have all the clients running before starting the read and write requests.")
+						fmt.Println("Do you want to start the read and write requests from the clients? (y/n)")
+						fmt.Scanln(&answer)
+
+						if answer == "y" {
+							for _, ip := range client.Peers {
+								go func() {
+									_, err := utils.CallByRPC(ip, "Client.RequestPage", message.Message{})
+									if err != nil {
+										fmt.Println("Error occurred while calling RequestPage RPC: ", err)
+									}
+								}()
+							}
+							return
+						}
+						fmt.Println("The option to start the read and write requests will be displayed again shortly...")
+					}
+				}()
+			}
 
 			// Handling when the node fails or is shut down
 			sigChan := make(chan os.Signal, 1)
@@ -168,23 +308,15 @@ func main() {
 				<-sigChan
 				fmt.Println("Shutting down...")
 
-				// Remove the node from the list
-				nodesList := utils.ReadNodesList()
-
-				delete(nodesList, client.ID) // remove the element that left the network from the nodesList
-
-				jsonData, err := json.Marshal(nodesList)
-				if err != nil {
-					fmt.Println("Error occurred while updating nodes-list.json: ", err)
-				}
-				err = ioutil.WriteFile("nodes-list.json", jsonData, os.ModePerm)
+				// Hand the pages back and remove the node from the membership table
+				err := client.Leave()
 				if err != nil {
-					fmt.Println("Error occurred while updating nodes-list.json: ", err)
+					fmt.Println(err)
 				}
 				os.Exit(0)
 			}()
 		default:
-			fmt.Println("Usage: go run main.go -cm OR go run main.go -cl OR go run main.go -b")
+			fs.Usage()
 			return
 		}
 	select {}
@@ -8,4 +8,10 @@ type Message struct {
 	Permission string
 	AvgReadPerNode float64
 	AvgWritePerNode float64
+	Data       []byte // Contents of the page being transferred
+	CopySet    []string // IPs of the clients holding a copy of the page, handed to the new owner
+	Epoch      int // Epoch of the central manager the message comes from or is meant for
+	RequestID  string // Unique id of the READ or WRITE request the message belongs to, kept when the request is retried
+	Pages      map[int]string // Page ids cached by a client and its permission on each, reported when the central manager recovers
+	Contents   map[int][]byte // Contents of the pages cached by a client, handed back when it leaves
 }
\ No newline at end of file
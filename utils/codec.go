@@ -0,0 +1,129 @@
+package utils
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/gob"
+	"fmt"
+	"io"
+	"net"
+	"net/rpc"
+	"sync"
+)
+
+const PERMISSION_DENIED = "permission denied"
+
+// Checks the arguments of a call from a peer that authenticated with a certificate once they have been decoded.
+// args is a pointer to the arguments, and an error refuses the call.
+type Guard func(peer Peer, method string, args interface{}) error
+
+// Serves the RPCs coming in on conn with server.
+// When the peer authenticated with a TLS certificate, the methods in privileged are only served to central managers,
+// the calls that guard refuses are not served either, and the peer gets a PERMISSION_DENIED error back for them.
+// Peers on a transport without certificates are not checked.
+func ServeConn(server *rpc.Server, conn net.Conn, privileged map[string]bool, guard Guard) {
+	tlsConn, ok := conn.(*tls.Conn)
+	if !ok {
+		server.ServeConn(conn)
+		return
+	}
+	if err := tlsConn.Handshake(); err != nil {
+		conn.Close() // Not one of the nodes of the cluster
+		return
+	}
+	server.ServeCodec(&guardCodec{
+		ServerCodec: newGobServerCodec(conn),
+		peer:        PeerOf(tlsConn.ConnectionState()),
+		privileged:  privileged,
+		guard:       guard,
+	})
+}
+
+// Server codec that answers the calls the peer is not allowed to make itself, so the server never sees them
+type guardCodec struct {
+	rpc.ServerCodec
+	lock       sync.Mutex // Replies are written both by the server and by the guard
+	peer       Peer
+	privileged map[string]bool
+	guard      Guard
+	method     string // Method of the call whose arguments are read next
+}
+
+func (g *guardCodec) ReadRequestHeader(r *rpc.Request) error {
+	for {
+		*r = rpc.Request{} // Decoding leaves the fields missing from the stream untouched
+		if err := g.ServerCodec.ReadRequestHeader(r); err != nil {
+			return err
+		}
+		if g.peer.Role == MANAGER || !g.privileged[r.ServiceMethod] {
+			g.method = r.ServiceMethod
+			return nil
+		}
+		if err := g.ServerCodec.ReadRequestBody(nil); err != nil {
+			return err
+		}
+		err := g.WriteResponse(&rpc.Response{
+			ServiceMethod: r.ServiceMethod,
+			Seq:           r.Seq,
+			Error:         fmt.Sprintf("%s: %s is only served to central managers", PERMISSION_DENIED, r.ServiceMethod),
+		}, struct{}{})
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// Reads the arguments of the call and has the guard check them.
+// The server answers an error from here with an error response and goes on with the next call.
+func (g *guardCodec) ReadRequestBody(body interface{}) error {
+	if err := g.ServerCodec.ReadRequestBody(body); err != nil || g.guard == nil || body == nil {
+		return err
+	}
+	if err := g.guard(g.peer, g.method, body); err != nil {
+		return fmt.Errorf("%s: %s", PERMISSION_DENIED, err)
+	}
+	return nil
+}
+
+func (g *guardCodec) WriteResponse(r *rpc.Response, body interface{}) error {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	return g.ServerCodec.WriteResponse(r, body)
+}
+
+// Same encoding as rpc.ServeConn uses, which does not export its codec
+type gobServerCodec struct {
+	rwc    io.ReadWriteCloser
+	dec    *gob.Decoder
+	enc    *gob.Encoder
+	encBuf *bufio.Writer
+}
+
+func newGobServerCodec(conn io.ReadWriteCloser) *gobServerCodec {
+	buf := bufio.NewWriter(conn)
+	return &gobServerCodec{rwc: conn, dec: gob.NewDecoder(conn), enc: gob.NewEncoder(buf), encBuf: buf}
+}
+
+func (c *gobServerCodec) ReadRequestHeader(r *rpc.Request) error {
+	return c.dec.Decode(r)
+}
+
+func (c *gobServerCodec) ReadRequestBody(body interface{}) error {
+	return c.dec.Decode(body)
+}
+
+func (c *gobServerCodec) WriteResponse(r *rpc.Response, body interface{}) error {
+	if err := c.enc.Encode(r); err != nil {
+		c.rwc.Close() // The stream is broken, the peer could not make sense of the rest
+		return err
+	}
+	if err := c.enc.Encode(body); err != nil {
+		c.rwc.Close()
+		return err
+	}
+	return c.encBuf.Flush()
+}
+
+func (c *gobServerCodec) Close() error {
+	return c.rwc.Close()
+}
@@ -0,0 +1,141 @@
+package utils
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+// Faulty wraps another transport and injects network faults into the connections opened through it,
+// to see how the nodes cope with peers that are unreachable, slow or drop off in the middle of a call.
+// Give every node its own Faulty over a shared transport to control the faults each of them sees.
+type Faulty struct {
+	inner    Transport
+	lock     sync.Mutex
+	cut      map[string]bool      // Addresses that cannot be reached through this transport
+	latency  time.Duration        // Delay added to every write
+	dropRate float64              // Chance of a write breaking its connection instead of going out
+	conns    map[*faultyConn]bool // Open connections, closed when their address is cut
+}
+
+func NewFaulty(inner Transport) *Faulty {
+	return &Faulty{inner: inner, cut: make(map[string]bool), conns: make(map[*faultyConn]bool)}
+}
+
+// Makes the addresses unreachable: dialing them fails and the connections already open to them are closed.
+// Only the connections dialed through this transport are cut, so a full partition also needs the other side cut.
+func (f *Faulty) Cut(addrs ...string) {
+	f.lock.Lock()
+	var cut []*faultyConn
+	for _, addr := range addrs {
+		f.cut[addr] = true
+	}
+	for conn := range f.conns {
+		if f.cut[conn.addr] {
+			cut = append(cut, conn)
+		}
+	}
+	f.lock.Unlock()
+	for _, conn := range cut {
+		conn.Close()
+	}
+}
+
+// Makes the addresses reachable again
+func (f *Faulty) Heal(addrs ...string) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	for _, addr := range addrs {
+		delete(f.cut, addr)
+	}
+}
+
+// Delays every write by d, 0 for none
+func (f *Faulty) SetLatency(d time.Duration) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.latency = d
+}
+
+// Makes each write break its connection with the given chance, between 0 and 1
+func (f *Faulty) SetDropRate(rate float64) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.dropRate = rate
+}
+
+func (f *Faulty) Dial(ctx context.Context, addr string) (net.Conn, error) {
+	f.lock.Lock()
+	cut := f.cut[addr]
+	f.lock.Unlock()
+	if cut {
+		return nil, fmt.Errorf("dial %s: network is unreachable", addr)
+	}
+	conn, err := f.inner.Dial(ctx, addr)
+	if err != nil {
+		return nil, err
+	}
+	return f.track(conn, addr), nil
+}
+
+func (f *Faulty) Listen(addr string) (net.Listener, error) {
+	listener, err := f.inner.Listen(addr)
+	if err != nil {
+		return nil, err
+	}
+	return &faultyListener{Listener: listener, faulty: f}, nil
+}
+
+// Wraps the connection so that the faults apply to it
+func (f *Faulty) track(conn net.Conn, addr string) *faultyConn {
+	wrapped := &faultyConn{Conn: conn, faulty: f, addr: addr}
+	f.lock.Lock()
+	f.conns[wrapped] = true
+	f.lock.Unlock()
+	return wrapped
+}
+
+// Connection opened through a Faulty transport, addr is empty for the accepted ones
+type faultyConn struct {
+	net.Conn
+	faulty *Faulty
+	addr   string
+}
+
+func (c *faultyConn) Write(b []byte) (int, error) {
+	c.faulty.lock.Lock()
+	latency, dropRate := c.faulty.latency, c.faulty.dropRate
+	c.faulty.lock.Unlock()
+	if latency > 0 {
+		time.Sleep(latency)
+	}
+	if dropRate > 0 && rand.Float64() < dropRate {
+		c.Close()
+		return 0, fmt.Errorf("write to %s: connection reset (injected)", c.RemoteAddr())
+	}
+	return c.Conn.Write(b)
+}
+
+func (c *faultyConn) Close() error {
+	c.faulty.lock.Lock()
+	delete(c.faulty.conns, c)
+	c.faulty.lock.Unlock()
+	return c.Conn.Close()
+}
+
+// Listener of a Faulty transport, the faults apply to the replies sent on the accepted connections
+type faultyListener struct {
+	net.Listener
+	faulty *Faulty
+}
+
+func (l *faultyListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return l.faulty.track(conn, ""), nil
+}
@@ -0,0 +1,108 @@
+package utils
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+)
+
+// Memory is a transport between nodes living in the same process. Every connection is a pair of in-memory pipes
+// handed to the listener over a channel, so a whole cluster can run inside one binary without opening any sockets.
+// The addresses only have to be unique within the Memory, and one ending in port 0 is given a free port.
+type Memory struct {
+	lock      sync.Mutex
+	listeners map[string]*memoryListener
+	nextPort  int // Last port handed out for addresses ending in port 0
+}
+
+func NewMemory() *Memory {
+	return &Memory{listeners: make(map[string]*memoryListener), nextPort: 40000}
+}
+
+func (m *Memory) Dial(ctx context.Context, addr string) (net.Conn, error) {
+	m.lock.Lock()
+	listener, ok := m.listeners[addr]
+	m.lock.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("dial memory %s: connection refused", addr)
+	}
+
+	local, remote := net.Pipe()
+	select {
+	case listener.conns <- remote:
+		return local, nil
+	case <-listener.closed:
+		local.Close()
+		remote.Close()
+		return nil, fmt.Errorf("dial memory %s: connection refused", addr)
+	case <-ctx.Done():
+		local.Close()
+		remote.Close()
+		return nil, ctx.Err()
+	}
+}
+
+func (m *Memory) Listen(addr string) (net.Listener, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if port == "0" {
+		for {
+			m.nextPort++
+			addr = net.JoinHostPort(host, strconv.Itoa(m.nextPort))
+			if _, taken := m.listeners[addr]; !taken {
+				break
+			}
+		}
+	}
+	if _, taken := m.listeners[addr]; taken {
+		return nil, fmt.Errorf("listen memory %s: address already in use", addr)
+	}
+	listener := &memoryListener{memory: m, addr: memoryAddr(addr), conns: make(chan net.Conn), closed: make(chan struct{})}
+	m.listeners[addr] = listener
+	return listener, nil
+}
+
+// Listener end of a Memory transport
+type memoryListener struct {
+	memory *Memory
+	addr   memoryAddr
+	conns  chan net.Conn // Server ends of the pipes dialed to this listener
+	closed chan struct{} // Closed once the listener is
+	once   sync.Once
+}
+
+func (l *memoryListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+// Stops accepting connections and frees the address, the connections already accepted stay open
+func (l *memoryListener) Close() error {
+	l.once.Do(func() {
+		l.memory.lock.Lock()
+		delete(l.memory.listeners, string(l.addr))
+		l.memory.lock.Unlock()
+		close(l.closed)
+	})
+	return nil
+}
+
+func (l *memoryListener) Addr() net.Addr {
+	return l.addr
+}
+
+type memoryAddr string
+
+func (a memoryAddr) Network() string { return "memory" }
+func (a memoryAddr) String() string  { return string(a) }
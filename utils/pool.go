@@ -0,0 +1,196 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"ivy/message"
+	"net/rpc"
+	"sync"
+	"time"
+)
+
+// Pool keeps one persistent RPC connection per peer address and shares it between concurrent calls.
+// A connection that breaks is dropped and the next call to that peer dials a fresh one.
+type Pool struct {
+	lock      sync.Mutex
+	transport Transport // Carries the connections to the peers
+	clients   map[string]*rpc.Client
+	timeout   time.Duration            // Deadline of the calls without a deadline of their own, 0 for none
+	timeouts  map[string]time.Duration // Deadlines by message type or method name, overriding timeout
+}
+
+// Pool used by CallByRPC and by the nodes that keep to the TCP transport
+var DefaultPool = NewPool(TCP{})
+
+func NewPool(transport Transport) *Pool {
+	return &Pool{transport: transport, clients: make(map[string]*rpc.Client), timeouts: make(map[string]time.Duration)}
+}
+
+// Returns a new pool that reaches the peers over transport, with the same deadlines as this one
+func (p *Pool) WithTransport(transport Transport) *Pool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	pool := NewPool(transport)
+	pool.timeout = p.timeout
+	for key, t := range p.timeouts {
+		pool.timeouts[key] = t
+	}
+	return pool
+}
+
+// TimeoutError is returned when a call does not complete before its deadline.
+// It matches context.DeadlineExceeded with errors.Is.
+type TimeoutError struct {
+	IP     string
+	Method string
+	After  time.Duration // How long the call was given
+}
+
+func (e *TimeoutError) Error() string {
+	return fmt.Sprintf("%s on %s timed out after %s", e.Method, e.IP, e.After)
+}
+
+func (e *TimeoutError) Unwrap() error {
+	return context.DeadlineExceeded
+}
+
+// Checks if a call failed because it ran out of time
+func IsTimeout(err error) bool {
+	var timeoutErr *TimeoutError
+	return errors.As(err, &timeoutErr)
+}
+
+// Sets the default deadline of the calls, and the deadlines of the calls carrying the given message types or made to the given methods
+func (p *Pool) SetTimeouts(timeout time.Duration, timeouts map[string]time.Duration) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.timeout = timeout
+	p.timeouts = make(map[string]time.Duration, len(timeouts))
+	for key, t := range timeouts {
+		p.timeouts[key] = t
+	}
+}
+
+// Returns the deadline for calls carrying the message type or made to the method named by key
+func (p *Pool) TimeoutFor(key string) time.Duration {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if t, ok := p.timeouts[key]; ok {
+		return t
+	}
+	return p.timeout
+}
+
+// Derives a context that expires after the deadline configured for key, unless parent already has a deadline
+func (p *Pool) WithTimeout(parent context.Context, key string) (context.Context, context.CancelFunc) {
+	if _, ok := parent.Deadline(); ok {
+		return context.WithCancel(parent)
+	}
+	if t := p.TimeoutFor(key); t > 0 {
+		return context.WithTimeout(parent, t)
+	}
+	return context.WithCancel(parent)
+}
+
+// Sends msg to the method on the peer at ip and returns the reply.
+// Without a deadline in ctx the call gets the one configured for the type of msg,
+// and a call that runs out of time fails with a *TimeoutError.
+func (p *Pool) Send(ctx context.Context, ip string, method string, msg message.Message) (message.Message, error) {
+	ctx, cancel := p.WithTimeout(ctx, msg.Type)
+	defer cancel()
+
+	var reply message.Message
+	err := p.Call(ctx, ip, method, msg, &reply)
+	if err != nil {
+		return message.Message{}, fmt.Errorf("error in calling %s: %w", method, err)
+	}
+	return reply, nil
+}
+
+// Calls the method on the peer at ip over its pooled connection, giving up once ctx is done.
+// A call that runs out of time returns a *TimeoutError and only gives up on its own reply, the connection stays pooled
+// since other calls may still be waiting on it. A call that fails on the connection drops it.
+// If the pooled connection turns out to have been closed already, e.g. because the peer restarted,
+// the call is retried once on a fresh connection, which is safe since the request never went out.
+func (p *Pool) Call(ctx context.Context, ip string, method string, args interface{}, reply interface{}) error {
+	var after time.Duration
+	if deadline, ok := ctx.Deadline(); ok {
+		after = time.Until(deadline).Round(time.Millisecond)
+	}
+	for attempt := 0; ; attempt++ {
+		client, err := p.get(ctx, ip)
+		if err != nil && ctx.Err() == context.DeadlineExceeded {
+			return &TimeoutError{IP: ip, Method: method, After: after}
+		}
+		if err != nil {
+			return fmt.Errorf("error in dialing: %w", err)
+		}
+
+		call := client.Go(method, args, reply, make(chan *rpc.Call, 1))
+		select {
+		case <-call.Done:
+			err = call.Error
+		case <-ctx.Done():
+			if ctx.Err() == context.DeadlineExceeded {
+				return &TimeoutError{IP: ip, Method: method, After: after} // The reply is discarded when it arrives
+			}
+			return fmt.Errorf("%s on %s: %w", method, ip, ctx.Err()) // Cancelled, the reply is discarded when it arrives
+		}
+
+		var serverErr rpc.ServerError
+		if err == nil || errors.As(err, &serverErr) {
+			return err // The connection is fine, the peer answered
+		}
+		p.drop(ip, client)
+		if err != rpc.ErrShutdown || attempt > 0 {
+			return err
+		}
+	}
+}
+
+// Returns the pooled connection to ip, dialing one if there is none
+func (p *Pool) get(ctx context.Context, ip string) (*rpc.Client, error) {
+	p.lock.Lock()
+	client, ok := p.clients[ip]
+	p.lock.Unlock()
+	if ok {
+		return client, nil
+	}
+
+	// Dialed without the lock so that a slow peer does not hold up calls to the others
+	conn, err := p.transport.Dial(ctx, ip)
+	if err != nil {
+		return nil, err
+	}
+	client = rpc.NewClient(conn)
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if existing, ok := p.clients[ip]; ok {
+		client.Close() // Another call dialed the peer at the same time
+		return existing, nil
+	}
+	p.clients[ip] = client
+	return client, nil
+}
+
+// Removes the connection from the pool and closes it, unless it has already been replaced
+func (p *Pool) drop(ip string, client *rpc.Client) {
+	p.lock.Lock()
+	if p.clients[ip] == client {
+		delete(p.clients, ip)
+	}
+	p.lock.Unlock()
+	client.Close()
+}
+
+// Closes every pooled connection
+func (p *Pool) Close() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	for ip, client := range p.clients {
+		client.Close()
+		delete(p.clients, ip)
+	}
+}
@@ -0,0 +1,126 @@
+package utils
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"os"
+)
+
+const (
+	MANAGER = "manager" // Organizational unit of the certificates of the central managers
+	CLIENT  = "client"  // Role of every other authenticated node
+)
+
+// TLS wraps another transport in mutual TLS. Every node presents a certificate signed by the shared certificate
+// authority and checks the certificate of its peer, so only the nodes holding one can talk to the cluster.
+// A node is a central manager if MANAGER is one of the organizational units of its certificate.
+// Certificates are checked against the address dialed, so they need the IPs of their nodes as subject alternative names.
+type TLS struct {
+	inner  Transport
+	server *tls.Config
+	client *tls.Config
+}
+
+func NewTLS(inner Transport, cert tls.Certificate, ca *x509.CertPool) *TLS {
+	return &TLS{
+		inner: inner,
+		server: &tls.Config{
+			Certificates: []tls.Certificate{cert},
+			ClientAuth:   tls.RequireAndVerifyClientCert,
+			ClientCAs:    ca,
+			MinVersion:   tls.VersionTLS12,
+		},
+		client: &tls.Config{
+			Certificates: []tls.Certificate{cert},
+			RootCAs:      ca,
+			MinVersion:   tls.VersionTLS12,
+		},
+	}
+}
+
+// Reads the certificate, its key and the certificate authority from PEM files
+func LoadTLS(inner Transport, certFile string, keyFile string, caFile string) (*TLS, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("error loading the TLS certificate: %s", err)
+	}
+	data, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, fmt.Errorf("error reading the certificate authority: %s", err)
+	}
+	ca := x509.NewCertPool()
+	if !ca.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no certificates found in %s", caFile)
+	}
+	return NewTLS(inner, cert, ca), nil
+}
+
+func (t *TLS) Dial(ctx context.Context, addr string) (net.Conn, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := t.inner.Dial(ctx, addr)
+	if err != nil {
+		return nil, err
+	}
+	config := t.client.Clone()
+	config.ServerName = host
+	tlsConn := tls.Client(conn, config)
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return tlsConn, nil
+}
+
+func (t *TLS) Listen(addr string) (net.Listener, error) {
+	listener, err := t.inner.Listen(addr)
+	if err != nil {
+		return nil, err
+	}
+	return tls.NewListener(listener, t.server), nil
+}
+
+// Identity of the peer of a TLS connection, found in the certificate it presented
+type Peer struct {
+	Role  string   // MANAGER or CLIENT, empty when the peer presented no certificate
+	Hosts []string // IP addresses and host names the certificate was issued for
+}
+
+func PeerOf(state tls.ConnectionState) Peer {
+	if len(state.PeerCertificates) == 0 {
+		return Peer{}
+	}
+	cert := state.PeerCertificates[0]
+	peer := Peer{Role: CLIENT, Hosts: append([]string{}, cert.DNSNames...)}
+	for _, unit := range cert.Subject.OrganizationalUnit {
+		if unit == MANAGER {
+			peer.Role = MANAGER
+		}
+	}
+	for _, ip := range cert.IPAddresses {
+		peer.Hosts = append(peer.Hosts, ip.String())
+	}
+	return peer
+}
+
+// Checks if the certificate of the peer was issued for the host of addr
+func (p Peer) Owns(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		host = ip.String() // The same form as the addresses in the certificate
+	}
+	for _, h := range p.Hosts {
+		if h == host {
+			return true
+		}
+	}
+	return false
+}
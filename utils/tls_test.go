@@ -0,0 +1,232 @@
+package utils
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"math/big"
+	"net"
+	"net/rpc"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Certificate authority that signs the certificates of a test cluster
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pool *x509.CertPool
+}
+
+func newTestCA(t *testing.T) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return &testCA{cert: cert, key: key, pool: pool}
+}
+
+// Issues a certificate for 127.0.0.1 with the given organizational unit
+func (ca *testCA) issue(t *testing.T, unit string) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: unit, OrganizationalUnit: []string{unit}},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+type Echo struct{}
+
+func (Echo) Say(args string, reply *string) error {
+	*reply = args
+	return nil
+}
+
+func (Echo) Admin(args string, reply *string) error {
+	*reply = "admin " + args
+	return nil
+}
+
+// Serves Echo over TLS on addr, with Echo.Admin only for central managers and "forbidden" refused by the guard
+func serveEcho(t *testing.T, transport Transport, addr string) {
+	t.Helper()
+	server := rpc.NewServer()
+	if err := server.Register(Echo{}); err != nil {
+		t.Fatal(err)
+	}
+	listener, err := transport.Listen(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	guard := func(peer Peer, method string, args interface{}) error {
+		if s, ok := args.(*string); ok && *s == "forbidden" {
+			return errors.New("forbidden is refused")
+		}
+		return nil
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go ServeConn(server, conn, map[string]bool{"Echo.Admin": true}, guard)
+		}
+	}()
+}
+
+func dialEcho(t *testing.T, transport Transport, addr string) *rpc.Client {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	conn, err := transport.Dial(ctx, addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := rpc.NewClient(conn)
+	t.Cleanup(func() { client.Close() })
+	return client
+}
+
+func TestGuardCodecRefusesClients(t *testing.T) {
+	ca := newTestCA(t)
+	memory := NewMemory()
+	manager := NewTLS(memory, ca.issue(t, MANAGER), ca.pool)
+	client := NewTLS(memory, ca.issue(t, CLIENT), ca.pool)
+	serveEcho(t, manager, "127.0.0.1:9000")
+
+	c := dialEcho(t, client, "127.0.0.1:9000")
+	var reply string
+	err := c.Call("Echo.Admin", "hello", &reply)
+	if err == nil || !strings.Contains(err.Error(), PERMISSION_DENIED) {
+		t.Fatalf("client called a privileged method: %v", err)
+	}
+	err = c.Call("Echo.Say", "forbidden", &reply)
+	if err == nil || !strings.HasPrefix(err.Error(), PERMISSION_DENIED+": forbidden is refused") {
+		t.Fatalf("guard did not refuse the client: %v", err)
+	}
+
+	// The connection keeps serving the calls after the refused ones
+	if err := c.Call("Echo.Say", "hello", &reply); err != nil || reply != "hello" {
+		t.Fatalf("call after a refused one: %q %v", reply, err)
+	}
+}
+
+func TestGuardCodecServesManagers(t *testing.T) {
+	ca := newTestCA(t)
+	memory := NewMemory()
+	manager := NewTLS(memory, ca.issue(t, MANAGER), ca.pool)
+	serveEcho(t, manager, "127.0.0.1:9000")
+
+	c := dialEcho(t, manager, "127.0.0.1:9000")
+	var reply string
+	if err := c.Call("Echo.Admin", "hello", &reply); err != nil || reply != "admin hello" {
+		t.Fatalf("manager calling a privileged method: %q %v", reply, err)
+	}
+	err := c.Call("Echo.Say", "forbidden", &reply)
+	if err == nil || !strings.Contains(err.Error(), PERMISSION_DENIED) {
+		t.Fatalf("guard did not check the manager: %v", err)
+	}
+}
+
+func TestGuardCodecRefusesOtherAuthorities(t *testing.T) {
+	ca := newTestCA(t)
+	rogue := newTestCA(t)
+	memory := NewMemory()
+	manager := NewTLS(memory, ca.issue(t, MANAGER), ca.pool)
+	serveEcho(t, manager, "127.0.0.1:9000")
+
+	// Signed by another authority, the handshake fails and nothing is served
+	impostor := NewTLS(memory, rogue.issue(t, MANAGER), ca.pool)
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	conn, err := impostor.Dial(ctx, "127.0.0.1:9000")
+	if err == nil {
+		c := rpc.NewClient(conn)
+		defer c.Close()
+		var reply string
+		if err := c.Call("Echo.Say", "hello", &reply); err == nil {
+			t.Fatal("certificate of another authority was served")
+		}
+	}
+}
+
+func TestPeerOwns(t *testing.T) {
+	peer := Peer{Role: CLIENT, Hosts: []string{"node1.example", "10.0.0.1", "::1"}}
+	tests := []struct {
+		addr string
+		want bool
+	}{
+		{"10.0.0.1:8080", true},
+		{"node1.example:8080", true},
+		{"[::1]:8080", true},
+		{"[0:0:0:0:0:0:0:1]:8080", true}, // Same address written out in full
+		{"10.0.0.2:8080", false},
+		{"node2.example:8080", false},
+		{"10.0.0.1", false}, // No port
+	}
+	for _, test := range tests {
+		if got := peer.Owns(test.addr); got != test.want {
+			t.Errorf("Owns(%q) = %v, want %v", test.addr, got, test.want)
+		}
+	}
+}
+
+func TestPeerOf(t *testing.T) {
+	ca := newTestCA(t)
+	for _, unit := range []string{MANAGER, CLIENT} {
+		cert := ca.issue(t, unit)
+		leaf, err := x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		peer := PeerOf(tls.ConnectionState{PeerCertificates: []*x509.Certificate{leaf}})
+		if peer.Role != unit || !peer.Owns("127.0.0.1:9000") {
+			t.Errorf("peer of a %s certificate: %+v", unit, peer)
+		}
+	}
+	if peer := PeerOf(tls.ConnectionState{}); peer.Role != "" {
+		t.Errorf("peer without a certificate: %+v", peer)
+	}
+}
@@ -0,0 +1,43 @@
+package utils
+
+import (
+	"context"
+	"net"
+	"strings"
+)
+
+// Transport carries the connections between the nodes. The RPCs are encoded with gob on top of it,
+// so a node can be moved onto another transport without changing how it talks to the others.
+type Transport interface {
+	// Opens a connection to the node listening on addr, giving up once ctx is done
+	Dial(ctx context.Context, addr string) (net.Conn, error)
+	// Starts accepting the connections made to addr
+	Listen(addr string) (net.Listener, error)
+}
+
+// Checks if a call failed because the peer is not running: its host refused the connection, or the connection was
+// closed or reset before the reply came back, as happens when the process has just died or is restarting.
+// A peer that is cut off by the network times out or cannot be dialed at all instead.
+func IsDown(err error) bool {
+	if err == nil {
+		return false
+	}
+	for _, reason := range []string{"connection refused", "connection reset", "connection is shut down", "EOF"} {
+		if strings.Contains(err.Error(), reason) {
+			return true
+		}
+	}
+	return false
+}
+
+// TCP is the transport between nodes in separate processes or hosts
+type TCP struct{}
+
+func (TCP) Dial(ctx context.Context, addr string) (net.Conn, error) {
+	var dialer net.Dialer
+	return dialer.DialContext(ctx, "tcp", addr)
+}
+
+func (TCP) Listen(addr string) (net.Listener, error) {
+	return net.Listen("tcp", addr)
+}
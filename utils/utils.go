@@ -1,44 +1,30 @@
 package utils
 
 import (
-	"encoding/json"
+	"context"
+	"errors"
 	"fmt"
-	"io/ioutil"
 	"ivy/message"
 	"net/rpc"
-	"os"
 )
 
-// Utility function to call RPC methods
+// Utility function to call RPC methods, over the pooled connection to IP.
+// The call gets the deadline configured for the type of msg, see CallByRPCContext.
 func CallByRPC(IP string, method string, msg message.Message) (message.Message, error) {
-	client, err := rpc.Dial("tcp", IP)
-	if err != nil {
-		return message.Message{}, fmt.Errorf("error in dialing: %s", err)
-	}
-	defer client.Close()
-
-	var reply message.Message
-	err = client.Call(method, msg, &reply)
-	if err != nil {
-		return message.Message{}, fmt.Errorf("error in calling %s: %s", method, err)
-	}
-	return reply, nil
+	return CallByRPCContext(context.Background(), IP, method, msg)
 }
 
-func ReadNodesList() map[int]string {
-	jsonFile, err := os.Open("nodes-list.json")
-	if err != nil {
-		fmt.Println("Error opening nodes-list.json file:", err)
-	}
-	defer jsonFile.Close()
-
-	byteValue, _ := ioutil.ReadAll(jsonFile)
-
-	var nodesList map[int]string
-
-	json.Unmarshal(byteValue, &nodesList) // Puts the byte value into the nodesList map
+// Calls the RPC method, giving up once ctx is done.
+// Without a deadline in ctx the call gets the one configured in DefaultPool for the type of msg,
+// and a call that runs out of time fails with a *TimeoutError.
+func CallByRPCContext(ctx context.Context, IP string, method string, msg message.Message) (message.Message, error) {
+	return DefaultPool.Send(ctx, IP, method, msg)
+}
 
-	return nodesList
+// Checks if a call failed because the node could not be reached, rather than because the node returned an error
+func IsUnreachable(err error) bool {
+	var serverErr rpc.ServerError
+	return err != nil && !errors.As(err, &serverErr)
 }
 
 func ShowMenu(){
@@ -48,8 +34,11 @@ func ShowMenu(){
 	fmt.Println(red + "--------------------------------" + reset)
 	fmt.Println(red + "\t\tMENU" + reset)
 	fmt.Println(red + "Enter 1 to see the records" + reset)
-	fmt.Println(red + "Enter 2 to see the Write queue" + reset)
+	fmt.Println(red + "Enter 2 to see the page queues" + reset)
 	fmt.Println(red + "Enter 3 to kill current node" + reset)
 	fmt.Println(red + "Enter 4 to reboot current node" + reset)
+	fmt.Println(red + "Enter 5 to see the members" + reset)
+	fmt.Println(red + "Enter 6 to see the replication status" + reset)
+	fmt.Println(red + "Enter 7 to see the client liveness" + reset)
 	fmt.Println(red + "--------------------------------" + reset)
 }
\ No newline at end of file